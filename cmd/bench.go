@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"runtime"
+	"runtime/metrics"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/alecthomas/kong"
+
+	"dst/internal/bitrate"
+	"dst/internal/player"
+	"dst/internal/server"
+)
+
+type BenchViewers struct {
+	URL      *url.URL        `arg:"" optional:"" env:"CONNECT_URL" help:"URL to connect to. By default in-process server is started, and its cost is included in measurements"`
+	Bitrate  bitrate.Bitrate `short:"b" env:"BITRATE" help:"Emulated bitrate of every viewer" default:"64k"`
+	Viewers  []int           `env:"VIEWERS" help:"Numbers of viewers to measure with, one round for each" default:"100,1000,10000"`
+	Duration time.Duration   `env:"DURATION" help:"How long to play in every round before measuring" default:"10s"`
+}
+
+func (b *BenchViewers) Validate() error {
+	if b.Bitrate <= 0 {
+		return fmt.Errorf("bitrate must be positive")
+	}
+
+	for _, n := range b.Viewers {
+		if n < 1 {
+			return fmt.Errorf("number of viewers must be at least 1")
+		}
+	}
+
+	if b.Duration <= 0 {
+		return fmt.Errorf("duration must be positive")
+	}
+
+	return nil
+}
+
+func (b *BenchViewers) Run() error {
+	u := b.URL
+	if u == nil {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			return err
+		}
+		defer l.Close()
+
+		go func() {
+			_ = http.Serve(l, server.NewHandler(server.Options{RandomBytes: 16 << 10}))
+		}()
+
+		u = &url.URL{Scheme: "http", Host: l.Addr().String(), Path: "/"}
+	}
+
+	// Thousands of viewers would flood the log otherwise
+	defaultLogger := slog.Default()
+	slog.SetDefault(slog.New(discardHandler{}))
+	defer slog.SetDefault(defaultLogger)
+
+	fmt.Printf("%10s %14s %14s %12s %10s %14s\n",
+		"viewers", "memory", "per viewer", "goroutines", "cpu", "cpu per viewer")
+
+	for _, n := range b.Viewers {
+		r, err := b.round(u, n)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("%10d %12.1fMB %12.1fKB %12d %9.1f%% %13.3f%%\n",
+			n, float64(r.memory)/(1<<20), float64(r.memory)/float64(n)/(1<<10), r.goroutines,
+			r.cpu*100, r.cpu*100/float64(n))
+	}
+
+	return nil
+}
+
+type benchResult struct {
+	memory     uint64
+	goroutines int
+	// Cores used on average
+	cpu float64
+}
+
+func (b *BenchViewers) round(u *url.URL, n int) (benchResult, error) {
+	// Parsed like tester command line, so viewers get all its defaults, and its environment variables apply too
+	t := &Tester{}
+	parser, err := kong.New(t, kong.Name("tester"))
+	if err != nil {
+		return benchResult{}, err
+	}
+	args := []string{u.String(), "--objects=1", "--bitrate=" + b.Bitrate.String(), "--threads=" + strconv.Itoa(n)}
+	if _, err := parser.Parse(args); err != nil {
+		return benchResult{}, err
+	}
+
+	opts, err := t.downloaderOptions()
+	if err != nil {
+		return benchResult{}, err
+	}
+	content, err := t.contentModel()
+	if err != nil {
+		return benchResult{}, err
+	}
+	urls, err := t.urlPicker()
+	if err != nil {
+		return benchResult{}, err
+	}
+
+	runtime.GC()
+	memBefore := memoryInUse()
+	cpuBefore := cpuSeconds()
+
+	s := player.NewScheduler(time.Second / time.Duration(t.FPS))
+	s.Start()
+	defer s.Stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var wg sync.WaitGroup
+	wg.Add(n)
+	t.startViewers(opts, content, urls, s, ctx, func(error) {
+		wg.Done()
+	})
+
+	time.Sleep(b.Duration)
+
+	runtime.GC()
+	memAfter := memoryInUse()
+	r := benchResult{
+		memory:     memAfter - min(memBefore, memAfter),
+		goroutines: runtime.NumGoroutine(),
+		cpu:        (cpuSeconds() - cpuBefore) / b.Duration.Seconds(),
+	}
+
+	// Viewers stop with errors once context is cancelled, which is expected
+	cancel()
+	wg.Wait()
+
+	return r, nil
+}
+
+func memoryInUse() uint64 {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	return ms.HeapInuse + ms.StackInuse
+}
+
+func cpuSeconds() float64 {
+	samples := []metrics.Sample{
+		{Name: "/cpu/classes/total:cpu-seconds"},
+		{Name: "/cpu/classes/idle:cpu-seconds"},
+	}
+	metrics.Read(samples)
+
+	return samples[0].Value.Float64() - samples[1].Value.Float64()
+}
+
+type discardHandler struct{}
+
+func (discardHandler) Enabled(context.Context, slog.Level) bool  { return false }
+func (discardHandler) Handle(context.Context, slog.Record) error { return nil }
+func (h discardHandler) WithAttrs([]slog.Attr) slog.Handler      { return h }
+func (h discardHandler) WithGroup(string) slog.Handler           { return h }
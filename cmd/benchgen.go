@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"dst/internal/server"
+)
+
+type BenchGen struct {
+	Content       []server.ContentMode `env:"CONTENT" enum:"crypto,chacha8,xorshift,zero,text" help:"Content modes to measure, as in server --content" default:"crypto,chacha8,xorshift,zero,text"`
+	CompressRatio float64              `env:"COMPRESS_RATIO" help:"Compress ratio of content, as in server --compress-ratio" default:"1"`
+	RandomBytes   []int                `env:"RANDOM_BYTES" help:"Sizes of cycled crypto content block to measure, as in server --random-bytes" default:"16384,65536,1048576,16777216"`
+	Parallel      int                  `short:"p" env:"PARALLEL" help:"Number of goroutines reading from separate sources at once, like responses of server do" default:"1"`
+	Duration      time.Duration        `env:"DURATION" help:"How long to measure every source" default:"3s"`
+}
+
+func (b *BenchGen) Validate() error {
+	if b.CompressRatio < 1 {
+		return fmt.Errorf("compress ratio must be at least 1")
+	}
+
+	for _, n := range b.RandomBytes {
+		if n < 1 {
+			return fmt.Errorf("random bytes must be positive")
+		}
+	}
+
+	if b.Parallel < 1 {
+		return fmt.Errorf("parallel must be at least 1")
+	}
+
+	if b.Duration <= 0 {
+		return fmt.Errorf("duration must be positive")
+	}
+
+	return nil
+}
+
+// benchSource is content source server may respond with
+type benchSource struct {
+	name string
+	new  func() (io.Reader, error)
+}
+
+func (b *BenchGen) sources() []benchSource {
+	var sources []benchSource
+	for _, mode := range b.Content {
+		sources = append(sources, benchSource{string(mode), func() (io.Reader, error) {
+			return server.NewContentReader(mode, b.CompressRatio, 0)
+		}})
+	}
+
+	for _, n := range b.RandomBytes {
+		sources = append(sources, benchSource{fmt.Sprintf("cycle %d", n), func() (io.Reader, error) {
+			return server.NewContentReader(server.ContentCrypto, b.CompressRatio, n)
+		}})
+	}
+
+	return sources
+}
+
+func (b *BenchGen) Run() error {
+	fmt.Printf("%-20s %12s %8s %14s\n", "source", "throughput", "cpu", "per core")
+
+	for _, src := range b.sources() {
+		rate, cpu, err := b.measure(src)
+		if err != nil {
+			return fmt.Errorf("%s: %v", src.name, err)
+		}
+
+		fmt.Printf("%-20s %10.2fGB/s %7.1f%% %12.2fGB/s\n",
+			src.name, rate/(1<<30), cpu*100, rate/cpu/(1<<30))
+	}
+
+	return nil
+}
+
+// measure reads from Parallel sources for Duration, returning bytes read per second and cores used on average
+func (b *BenchGen) measure(src benchSource) (float64, float64, error) {
+	readers := make([]io.Reader, b.Parallel)
+	for i := range readers {
+		r, err := src.new()
+		if err != nil {
+			return 0, 0, err
+		}
+		readers[i] = r
+	}
+
+	var total atomic.Int64
+	var stop atomic.Bool
+	var wg sync.WaitGroup
+	errC := make(chan error, len(readers))
+
+	// CPU metrics are only brought up to date by GC
+	runtime.GC()
+	cpuBefore := cpuSeconds()
+	start := time.Now()
+	for _, r := range readers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			// Server reads sources in chunks of this size when bitrate is not limited
+			buf := make([]byte, 16<<10)
+			var n int64
+			for !stop.Load() {
+				n_, err := io.ReadFull(r, buf)
+				n += int64(n_)
+				if err != nil {
+					errC <- err
+					break
+				}
+			}
+			total.Add(n)
+		}()
+	}
+
+	time.Sleep(b.Duration)
+	stop.Store(true)
+	wg.Wait()
+	elapsed := time.Since(start)
+	runtime.GC()
+
+	select {
+	case err := <-errC:
+		return 0, 0, err
+	default:
+	}
+
+	return float64(total.Load()) / elapsed.Seconds(), (cpuSeconds() - cpuBefore) / elapsed.Seconds(), nil
+}
@@ -2,33 +2,106 @@ package main
 
 import (
 	"context"
+	"encoding/base64"
 	"fmt"
 	"log/slog"
+	"net"
+	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
 	"path"
 	"runtime"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/alecthomas/kong"
-	"golang.org/x/sync/errgroup"
 
 	"dst/internal/bitrate"
+	"dst/internal/catalog"
+	"dst/internal/downloader"
 	"dst/internal/logger"
 	"dst/internal/player"
+	"dst/internal/proxy"
 	"dst/internal/server"
 )
 
 type Tester struct {
-	URL               *url.URL        `arg:"" env:"CONNECT_URL" help:"URL to connect to"`
+	URLs              []string        `arg:"" name:"url" env:"CONNECT_URL" help:"URLs to connect to, viewers spread across them. May contain placeholders: {viewer} (number of the viewer), {seq} (sequential number modulo --objects), {random} (random number below --objects) and {catalog} (random line of --catalog file)"`
+	Weights           []float64       `name:"weight" env:"WEIGHTS" help:"Weights of URLs, one per URL. By default viewers spread evenly"`
+	Catalog           string          `type:"existingfile" env:"CATALOG" help:"File with values for {catalog} placeholder, one per line. Lines may be whole URLs"`
+	Objects           int             `env:"OBJECTS" help:"How many distinct values {seq} and {random} placeholders take" default:"1000"`
+	Popularity        string          `env:"POPULARITY" enum:"uniform,zipf" default:"uniform" help:"How viewers spread across {random} values and --catalog lines (ranked by order in the file, first is the most popular): uniform or zipf"`
+	ZipfExponent      float64         `env:"ZIPF_EXPONENT" help:"Exponent of Zipf popularity, higher means more skew towards popular items" default:"0.8"`
 	Bitrate           bitrate.Bitrate `required:"" short:"b" env:"BITRATE" help:"Target video emulated bitrate. Must be int with suffix of k, m or g, meaning kilobits, megabits and gigabits per second"`
 	Threads           int             `short:"t" env:"NUM_THREADS" help:"Number of threads to use, each with a separate connection and consuming specified bitrate" default:"1"`
 	BufferMin         int             `env:"BUFFER_MIN" help:"Keep buffering and NOT start playing until reached" default:"1"`
 	BufferMax         int             `env:"BUFFER_MAX" help:"Stop buffering when reached" default:"10"`
 	BufferToppedDelay int             `env:"BUFFER_TOPPED_DELAY" help:"When buffer is full, how long to wait before trying beginning to refill it again" default:"1"`
+
+	FPS          int     `env:"FPS" help:"Frame rate of emulated video, viewers consume content frame by frame" default:"24"`
+	PlaybackRate float64 `env:"PLAYBACK_RATE" help:"Playback speed multiplier, e.g. 1.25 or 2 to watch faster than real time" default:"1"`
+
+	GOPSize      int     `env:"GOP_SIZE" help:"Emulate variable bitrate with groups of pictures of this many frames, each starting with big I-frame. 0 means constant bitrate"`
+	IFrameRatio  float64 `env:"I_FRAME_RATIO" help:"How many times I-frames are bigger than other frames" default:"8"`
+	Complexity   float64 `env:"COMPLEXITY" help:"Emulate variable bitrate with scene complexity doing random walk every second. Sets walk volatility, e.g. 0.3 for about 30% deviations"`
+	BitrateTrace string  `type:"existingfile" env:"BITRATE_TRACE" help:"File with bitrate for every second of the content, one per line in the same format as --bitrate. Looped if content is longer"`
+
+	Live               bool          `env:"LIVE" help:"Treat URL as live HLS playlist (master or media): join at live edge and report live latency. DASH and low-latency HLS (with parts) are not supported and fail with error"`
+	LiveLatency        time.Duration `env:"LIVE_LATENCY" help:"Live latency viewer joins at and then tries to keep. By default 3 target durations of the playlist"`
+	LiveReportInterval time.Duration `env:"LIVE_REPORT_INTERVAL" help:"How often viewers report their live latency" default:"10s"`
+
+	PauseRate     float64       `env:"PAUSE_RATE" help:"How many times per minute of playback viewer pauses on average"`
+	PauseDuration time.Duration `env:"PAUSE_DURATION" help:"How long viewer stays paused on average" default:"10s"`
+	SeekRate      float64       `env:"SEEK_RATE" help:"How many times per minute of playback viewer seeks to random position on average. Requires content length to be known"`
+	SkipRate      float64       `env:"SKIP_RATE" help:"How many times per minute of playback viewer skips forward or backward on average"`
+	SkipDuration  time.Duration `env:"SKIP_DURATION" help:"How much content viewer skips at once" default:"10s"`
+
+	CACert        string   `type:"existingfile" env:"CA_CERT" help:"PEM file with additional CA certificates to trust"`
+	Insecure      bool     `short:"k" env:"INSECURE" help:"Do not verify server TLS certificate"`
+	ClientCert    string   `type:"existingfile" env:"CLIENT_CERT" help:"PEM client certificate for mutual TLS, requires --client-key"`
+	ClientKey     string   `type:"existingfile" env:"CLIENT_KEY" help:"PEM client private key for mutual TLS, requires --client-cert"`
+	SNI           string   `env:"SNI" help:"Override server name sent in TLS handshake and used to verify server certificate"`
+	TLSMinVersion string   `env:"TLS_MIN_VERSION" help:"Minimal TLS version, one of 1.0, 1.1, 1.2, 1.3"`
+	TLSMaxVersion string   `env:"TLS_MAX_VERSION" help:"Maximal TLS version, one of 1.0, 1.1, 1.2, 1.3"`
+	TLSCiphers    []string `env:"TLS_CIPHERS" help:"Comma-separated list of allowed cipher suites (Go names, e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256). Does not affect TLS 1.3"`
+
+	Headers     []string      `name:"header" short:"H" sep:"none" env:"HEADERS" help:"Extra request header in form of 'Name: value', can be repeated. Host header overrides request host"`
+	UserAgent   string        `short:"A" env:"USER_AGENT" help:"User-Agent header to send"`
+	BasicAuth   string        `env:"BASIC_AUTH" help:"Credentials for basic authentication in form of user:password"`
+	BearerToken string        `env:"BEARER_TOKEN" help:"Token for bearer authentication"`
+	CookieJar   bool          `env:"COOKIE_JAR" help:"Keep cookies set by the server and send them back, separately for every thread"`
+	SignKey     string        `env:"SIGN_KEY" help:"If set, URL is signed before every request with HMAC-SHA256 of URL path concatenated with expiry timestamp, keyed with this secret"`
+	SignParam   string        `env:"SIGN_PARAM" help:"Query parameter to put hex-encoded URL signature to" default:"token"`
+	SignExpires string        `env:"SIGN_EXPIRES_PARAM" help:"Query parameter to put signature expiry unix timestamp to" default:"expires"`
+	SignTTL     time.Duration `env:"SIGN_TTL" help:"How long signed URL stays valid" default:"1h"`
+
+	Resolve       []string `sep:"none" env:"RESOLVE" help:"Connect to given addresses instead of resolving host, in form of host:port:addr[,addr]..., can be repeated. With several addresses threads are spread across them round-robin"`
+	DNSServer     string   `env:"DNS_SERVER" help:"Resolve host names by querying this DNS server (ip:port) instead of using system resolver"`
+	DNSRoundRobin bool     `env:"DNS_ROUND_ROBIN" help:"Spread threads round-robin across all addresses the host resolves to"`
+	LocalAddrs    []string `name:"local-addr" env:"LOCAL_ADDRS" help:"Source IP addresses to bind connections to, threads are spread across them round-robin, so that every source address talks to every address of --resolve or --dns-round-robin"`
+	Interfaces    []string `name:"interface" env:"INTERFACES" help:"Bind connections to addresses of these network interfaces, threads are spread across them round-robin"`
+
+	Links []string `name:"link" sep:"none" env:"LINKS" help:"Emulate viewer link: one of 3g, lte, cable or custom in form of bw=2m,latency=100ms,jitter=20ms,loss=0.001 (any key may be omitted). Can be repeated, then threads are spread across links round-robin, so that every address of --resolve or --dns-round-robin is reached over every link. Applies to connections, so in shared and h2 modes link is shared by threads too"`
+
+	Segments    int `env:"SEGMENTS" help:"Download content by this many concurrent range requests, reassembled in order, like download managers do. Needs ranges support and known content length. 0 or 1 means single request"`
+	SegmentSize int `env:"SEGMENT_SIZE" help:"Size of every range request in segmented download, in kilobytes" default:"1024"`
+
+	ChunkStrategy downloader.ChunkStrategy `env:"CHUNK_STRATEGY" enum:"open,fixed,adaptive" default:"open" help:"How much every range request asks for: open (everything to the end), fixed (chunks of --chunk-size) or adaptive (as much as buffer lacks, but at least --chunk-size)"`
+	ChunkSize     int                      `env:"CHUNK_SIZE" help:"Size of range requests for fixed and adaptive chunk strategies, in kilobytes" default:"2048"`
+	Reconnect     bool                     `env:"RECONNECT" help:"Make every request over new connection, and drop response when buffer is full instead of keeping it open until buffer needs more. Not allowed in h2 connection mode"`
+
+	ConnectionMode downloader.ConnectionMode `env:"CONNECTION_MODE" enum:"dedicated,shared,h2" default:"dedicated" help:"How threads share connections: dedicated (every thread has its own connections), shared (single pool of HTTP/1.1 connections for all threads) or h2 (threads are multiplexed over HTTP/2 connections, requires https and fails if server does not support HTTP/2)"`
+	StreamsPerConn int                       `env:"STREAMS_PER_CONN" default:"100" help:"In h2 connection mode, how many threads share single connection"`
 }
 
 func (t *Tester) Validate() error {
+	if t.Bitrate <= 0 {
+		return fmt.Errorf("bitrate must be positive")
+	}
+
 	if t.BufferMin <= 0 {
 		return fmt.Errorf("minimal buffer duration must be positive")
 	}
@@ -49,35 +122,375 @@ func (t *Tester) Validate() error {
 		return fmt.Errorf("number of threads must be at least 1")
 	}
 
+	if t.FPS < 1 {
+		return fmt.Errorf("fps must be at least 1")
+	}
+
+	if t.PlaybackRate <= 0 {
+		return fmt.Errorf("playback rate must be positive")
+	}
+
+	if t.GOPSize < 0 {
+		return fmt.Errorf("GOP size must not be negative")
+	}
+
+	if t.IFrameRatio < 1 {
+		return fmt.Errorf("I-frame ratio must be at least 1")
+	}
+
+	if t.Complexity < 0 {
+		return fmt.Errorf("complexity must not be negative")
+	}
+
+	if t.LiveLatency < 0 {
+		return fmt.Errorf("live latency must not be negative")
+	}
+
+	if t.Live && (t.PauseRate > 0 || t.SeekRate > 0 || t.SkipRate > 0) {
+		return fmt.Errorf("pause, seek and skip emulation is not supported for live streams")
+	}
+
+	if t.Live && t.PlaybackRate != 1 {
+		return fmt.Errorf("playback rate is not supported for live streams, it is adjusted to keep live latency instead")
+	}
+
+	if t.PauseRate < 0 || t.SeekRate < 0 || t.SkipRate < 0 {
+		return fmt.Errorf("pause, seek and skip rates must not be negative")
+	}
+
+	if t.PauseDuration < 0 || t.SkipDuration < 0 {
+		return fmt.Errorf("pause and skip durations must not be negative")
+	}
+
+	if (t.ClientCert == "") != (t.ClientKey == "") {
+		return fmt.Errorf("client certificate and key must be set together")
+	}
+
+	if t.BasicAuth != "" && t.BearerToken != "" {
+		return fmt.Errorf("only one of basic auth and bearer token may be set")
+	}
+
+	if t.BasicAuth != "" && !strings.Contains(t.BasicAuth, ":") {
+		return fmt.Errorf("basic auth must be in form of user:password")
+	}
+
+	for _, h := range t.Headers {
+		if name, _, ok := strings.Cut(h, ":"); !ok || strings.TrimSpace(name) == "" {
+			return fmt.Errorf("header must be in form of 'Name: value', got %q", h)
+		}
+	}
+
+	if t.SignKey != "" && t.SignTTL <= 0 {
+		return fmt.Errorf("signed URL TTL must be positive")
+	}
+
+	for _, r := range t.Resolve {
+		if err := (&downloader.Dialer{}).ParseResolve(r); err != nil {
+			return err
+		}
+	}
+
+	for _, addr := range t.LocalAddrs {
+		if net.ParseIP(addr) == nil {
+			return fmt.Errorf("local address must be IP, got %q", addr)
+		}
+	}
+
+	for _, link := range t.Links {
+		if _, err := downloader.ParseLinkProfile(link); err != nil {
+			return err
+		}
+	}
+
+	if t.Segments < 0 {
+		return fmt.Errorf("number of segments must not be negative")
+	}
+
+	if t.SegmentSize < 1 {
+		return fmt.Errorf("segment size must be at least 1 kilobyte")
+	}
+
+	if t.Segments > 1 && t.Live {
+		return fmt.Errorf("segmented download is not supported for live streams")
+	}
+
+	if t.ChunkSize < 1 {
+		return fmt.Errorf("chunk size must be at least 1 kilobyte")
+	}
+
+	if t.Objects < 1 {
+		return fmt.Errorf("number of objects must be at least 1")
+	}
+
+	if t.ZipfExponent <= 0 {
+		return fmt.Errorf("zipf exponent must be positive")
+	}
+
+	if t.ConnectionMode == downloader.ConnectionHTTP2 && t.StreamsPerConn < 1 {
+		return fmt.Errorf("streams per connection must be at least 1")
+	}
+
+	if t.ConnectionMode == downloader.ConnectionHTTP2 && t.Reconnect {
+		// Closing the connection shared by many threads after every request would make them take turns
+		return fmt.Errorf("reconnect can not be used with h2 connection mode")
+	}
+
+	if t.DNSServer != "" {
+		if _, _, err := net.SplitHostPort(t.DNSServer); err != nil {
+			return fmt.Errorf("DNS server must be in form of ip:port: %v", err)
+		}
+	}
+
 	return nil
 }
 
 func (t *Tester) Run() error {
+	opts, err := t.downloaderOptions()
+	if err != nil {
+		return err
+	}
+
+	content, err := t.contentModel()
+	if err != nil {
+		return err
+	}
+
+	urls, err := t.urlPicker()
+	if err != nil {
+		return err
+	}
+
+	s := player.NewScheduler(time.Second / time.Duration(t.FPS))
+	s.Start()
+	defer s.Stop()
+
 	if t.Threads == 1 {
-		return t.run(slog.Default(), nil)
+		return t.newEmulator(urls.Pick(0), opts, content, s, slog.Default(), nil).Run()
 	}
 
-	wg, ctx := errgroup.WithContext(context.Background())
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+
+	var wg sync.WaitGroup
+	wg.Add(t.Threads)
+	t.startViewers(opts, content, urls, s, ctx, func(err error) {
+		if err != nil {
+			cancel(err)
+		}
+		wg.Done()
+	})
+	wg.Wait()
+
+	return context.Cause(ctx)
+}
+
+// startViewers starts every thread's playback without waiting, onDone is called for each once it is over
+func (t *Tester) startViewers(opts *downloader.Options, content *player.ContentModel, urls *catalog.Picker, s *player.Scheduler, ctx context.Context, onDone func(error)) {
 	for i := range t.Threads {
-		wg.Go(func() error {
-			return t.run(slog.Default().With(slog.Int("thread", i)), ctx)
-		})
+		u := urls.Pick(i)
+		l := slog.Default().With(slog.Int("thread", i))
+		l.Debug("Picked URL", slog.String("url", u.String()))
+
+		t.newEmulator(u, opts, content, s, l, ctx).Start(onDone)
+	}
+}
+
+func (t *Tester) urlPicker() (*catalog.Picker, error) {
+	copts := catalog.Options{
+		Weights:    t.Weights,
+		Objects:    t.Objects,
+		Popularity: catalog.Popularity(t.Popularity),
+		Exponent:   t.ZipfExponent,
+	}
+
+	if t.Catalog != "" {
+		f, err := os.Open(t.Catalog)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+
+		copts.Catalog, err = catalog.ReadCatalog(f)
+		if err != nil {
+			return nil, fmt.Errorf("bad catalog: %v", err)
+		}
+	}
+
+	p, err := catalog.NewPicker(t.URLs, copts)
+	if err != nil {
+		return nil, err
 	}
 
-	return wg.Wait()
+	if t.ConnectionMode == downloader.ConnectionHTTP2 && !p.AllHTTPS() {
+		return nil, fmt.Errorf("h2 connection mode requires https URLs")
+	}
+
+	return p, nil
 }
 
-func (t *Tester) run(l *slog.Logger, ctx context.Context) error {
-	b := player.NewBuffer(t.URL, t.Bitrate, t.BufferMin, t.BufferMax,
+func (t *Tester) downloaderOptions() (*downloader.Options, error) {
+	tlsOpts := downloader.TLSOptions{
+		CAFile:       t.CACert,
+		Insecure:     t.Insecure,
+		CertFile:     t.ClientCert,
+		KeyFile:      t.ClientKey,
+		ServerName:   t.SNI,
+		MinVersion:   t.TLSMinVersion,
+		MaxVersion:   t.TLSMaxVersion,
+		CipherSuites: t.TLSCiphers,
+	}
+	tlsConfig, err := tlsOpts.Config()
+	if err != nil {
+		return nil, err
+	}
+
+	header := make(http.Header)
+	for _, h := range t.Headers {
+		name, value, _ := strings.Cut(h, ":")
+		header.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+	}
+	if t.UserAgent != "" {
+		header.Set("User-Agent", t.UserAgent)
+	}
+	if t.BasicAuth != "" {
+		header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(t.BasicAuth)))
+	}
+	if t.BearerToken != "" {
+		header.Set("Authorization", "Bearer "+t.BearerToken)
+	}
+
+	var signer *downloader.URLSigner
+	if t.SignKey != "" {
+		signer = &downloader.URLSigner{
+			Key:          []byte(t.SignKey),
+			TokenParam:   t.SignParam,
+			ExpiresParam: t.SignExpires,
+			TTL:          t.SignTTL,
+		}
+	}
+
+	dialer := &downloader.Dialer{
+		RoundRobin: t.DNSRoundRobin,
+	}
+	for _, r := range t.Resolve {
+		if err := dialer.ParseResolve(r); err != nil {
+			return nil, err
+		}
+	}
+	if t.DNSServer != "" {
+		dialer.UseDNSServer(t.DNSServer)
+	}
+	for _, addr := range t.LocalAddrs {
+		dialer.LocalAddrs = append(dialer.LocalAddrs, net.ParseIP(addr))
+	}
+	for _, iface := range t.Interfaces {
+		if err := dialer.AddInterface(iface); err != nil {
+			return nil, err
+		}
+	}
+	for _, link := range t.Links {
+		p, err := downloader.ParseLinkProfile(link)
+		if err != nil {
+			return nil, err
+		}
+		dialer.Links = append(dialer.Links, p)
+	}
+
+	return &downloader.Options{
+		Dialer:    dialer,
+		TLSConfig: tlsConfig,
+		Header:    header,
+		CookieJar: t.CookieJar,
+		Signer:    signer,
+
+		ConnectionMode:       t.ConnectionMode,
+		StreamsPerConnection: t.StreamsPerConn,
+
+		Segments:    t.Segments,
+		SegmentSize: int64(t.SegmentSize) << 10,
+
+		ChunkStrategy: t.ChunkStrategy,
+		ChunkSize:     int64(t.ChunkSize) << 10,
+		Reconnect:     t.Reconnect,
+	}, nil
+}
+
+func (t *Tester) contentModel() (*player.ContentModel, error) {
+	m := &player.ContentModel{
+		GOPSize:     t.GOPSize,
+		IFrameRatio: t.IFrameRatio,
+		Complexity:  t.Complexity,
+	}
+
+	if t.BitrateTrace != "" {
+		f, err := os.Open(t.BitrateTrace)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+
+		m.Trace, err = bitrate.ReadTrace(f)
+		if err != nil {
+			return nil, fmt.Errorf("bad bitrate trace: %v", err)
+		}
+	}
+
+	return m, nil
+}
+
+func (t *Tester) newEmulator(u *url.URL, opts *downloader.Options, content *player.ContentModel, s *player.Scheduler, l *slog.Logger, ctx context.Context) player.Viewer {
+	if t.Live {
+		return player.NewLiveEmulator(u, opts, s, t.Bitrate, t.BufferMin, t.BufferMax,
+			time.Duration(t.BufferToppedDelay)*time.Second, player.LiveOptions{
+				TargetLatency:  t.LiveLatency,
+				ReportInterval: t.LiveReportInterval,
+			}, ctx, l)
+	}
+
+	b := player.NewBuffer(u, opts, s, t.Bitrate, content, t.BufferMin, t.BufferMax,
 		time.Duration(t.BufferToppedDelay)*time.Second, ctx, l)
-	p := player.NewEmulator(b)
-	return p.Run()
+	return player.NewEmulator(b, s, t.FPS, t.PlaybackRate, player.Behavior{
+		PauseRate:     t.PauseRate,
+		PauseDuration: t.PauseDuration,
+		SeekRate:      t.SeekRate,
+		SkipRate:      t.SkipRate,
+		SkipDuration:  t.SkipDuration,
+	})
 }
 
 type Server struct {
-	Port        *int            `arg:"" env:"PORT" help:"Port to listen on"`
-	Bitrate     bitrate.Bitrate `short:"b" env:"BITRATE" help:"Maximum bitrate for response, if desired. Must have suffix of k, m or g. By default bitrate is not artificially limited and depends only on your system CSPRNG and networking speed"`
-	RandomBytes int             `env:"RANDOM_BYTES" help:"If set, only this number of random bytes will be generated, and then just cycled to produce output. Can be used to remove throughput dependency on CSPRNG generator performance"`
+	Port          *int               `arg:"" env:"PORT" help:"Port to listen on"`
+	Bitrate       bitrate.Bitrate    `short:"b" env:"BITRATE" help:"Maximum bitrate for response, if desired. Must have suffix of k, m or g. By default bitrate is not artificially limited and depends only on --content generator and networking speed"`
+	Content       server.ContentMode `env:"CONTENT" enum:"crypto,chacha8,xorshift,zero,text" default:"crypto" help:"What to respond with: crypto (output of system CSPRNG, slow), chacha8 or xorshift (fast PRNGs), zero (all zero bytes) or text (random English words, compresses like real text)"`
+	CompressRatio float64            `env:"COMPRESS_RATIO" help:"Make crypto, chacha8 and xorshift content compressible about this many times, by zeroing the tail of every 4KB block. 1 means incompressible" default:"1"`
+	RandomBytes   int                `env:"RANDOM_BYTES" help:"If set, only this number of bytes of content will be generated, and then just cycled to produce output. Can be used to remove throughput dependency on generator performance, but cycled content may be deduplicated or compressed by middleboxes"`
+	Sendfile      bool               `env:"SENDFILE" help:"Write --random-bytes (64MB by default) of content to temporary file at start, and send it in a loop with zero-copy sendfile when responses have no bitrate, egress cap or aborts. Such responses are not chunked and end with connection, and they end once any of these limits is set with admin API"`
+	Root          string             `env:"ROOT" type:"existingdir" help:"Serve files from this directory instead of generated content, e.g. HLS packages or MP4s which real players can play. Range and conditional requests are supported, bitrate still paces responses"`
+
+	StatusPath    string        `env:"STATUS_PATH" help:"Path of status endpoint, which responds with JSON metrics: active connections, their lifetime and recent throughput, total egress and missed pacing ticks. Empty disables it" default:"/_dst/status"`
+	StatsInterval time.Duration `env:"STATS_INTERVAL" help:"How often to log summary of server metrics, 0 disables it" default:"10s"`
+
+	EgressCap     bitrate.Bitrate      `env:"EGRESS_CAP" help:"Cap total egress of all connections, like origin behind a fixed pipe. Must have suffix of k, m or g. By default egress is not capped"`
+	EgressSharing server.EgressSharing `env:"EGRESS_SHARING" enum:"fair,first-come" default:"fair" help:"How connections share egress cap: fair (equal share for every response, and share slow clients do not use goes to others) or first-come (whoever asks first gets bytes, so greedy clients get the most)"`
+
+	MaxConns     int           `env:"MAX_CONNS" help:"Maximum number of connections with requests in flight at once, requests over other connections get 503 or wait in queue. Idle keep-alive connections do not count. By default unlimited"`
+	QueueConns   bool          `env:"QUEUE_CONNS" help:"Make requests over connections beyond --max-conns wait in line for a free slot, first come first served, instead of getting 503 right away"`
+	QueueTimeout time.Duration `env:"QUEUE_TIMEOUT" help:"How long request may wait in queue before getting 503" default:"30s"`
+	FaultRate    float64       `env:"FAULT_RATE" help:"Probability of responding with --fault-status instead of content, from 0 to 1"`
+	FaultStatus  int           `env:"FAULT_STATUS" help:"HTTP status code of injected faults, from 400 to 599" default:"503"`
+	AbortRate    float64       `env:"ABORT_RATE" help:"Probability of cutting connection at random point of response, from 0 to 1"`
+
+	AdminPath  string `env:"ADMIN_PATH" help:"Path prefix of admin API, which changes bitrate, egress cap, connection limit and faults while server runs (GET or PUT {prefix}/settings as JSON), and drains or kills connections (POST {prefix}/drain or {prefix}/kill), e.g. /_dst/admin. Disabled by default, as it shares the port with content"`
+	AdminToken string `env:"ADMIN_TOKEN" help:"If set, admin API requires it as bearer token. Without it anyone who reaches the server may use admin API"`
+
+	PaceTick          time.Duration `env:"PACE_TICK" help:"How often paced responses write their budget of bytes" default:"40ms"`
+	PaceFlushInterval time.Duration `env:"PACE_FLUSH_INTERVAL" help:"How often paced responses are flushed to connection, 0 flushes on every tick" default:"200ms"`
+	PaceCatchUp       time.Duration `env:"PACE_CATCH_UP" help:"How much of bitrate budget, in time, paced response may catch up faster than bitrate after writing stalls. Time lost beyond that is lost for good, 0 never catches up" default:"1s"`
+
+	ReadHeaderTimeout time.Duration `env:"READ_HEADER_TIMEOUT" help:"How long client may take to send request headers" default:"10s"`
+	IdleTimeout       time.Duration `env:"IDLE_TIMEOUT" help:"How long idle keep-alive connection is kept open" default:"60s"`
+	ShutdownGrace     time.Duration `env:"SHUTDOWN_GRACE" help:"On SIGTERM or interrupt stop accepting connections, and let active ones keep streaming this long before cutting them" default:"10s"`
+	DrainOnShutdown   bool          `env:"DRAIN_ON_SHUTDOWN" help:"On SIGTERM or interrupt end responses cleanly right away, instead of letting them stream until grace period is over"`
 }
 
 func (s *Server) Validate() error {
@@ -97,11 +510,137 @@ func (s *Server) Validate() error {
 		return fmt.Errorf("random bytes must be positive")
 	}
 
-	return nil
+	if s.CompressRatio < 1 {
+		return fmt.Errorf("compress ratio must be at least 1")
+	}
+
+	if s.PaceTick <= 0 || s.PaceFlushInterval < 0 || s.PaceCatchUp < 0 {
+		return fmt.Errorf("pace tick must be positive, flush interval and catch up must not be negative")
+	}
+
+	if s.StatusPath != "" && !strings.HasPrefix(s.StatusPath, "/") {
+		return fmt.Errorf("status path must start with /")
+	}
+
+	if s.StatsInterval < 0 {
+		return fmt.Errorf("stats interval must not be negative")
+	}
+
+	if s.AdminPath != "" && !strings.HasPrefix(s.AdminPath, "/") {
+		return fmt.Errorf("admin path must start with /")
+	}
+
+	if s.QueueConns && s.QueueTimeout <= 0 {
+		return fmt.Errorf("queue timeout must be positive")
+	}
+
+	if s.ReadHeaderTimeout < 0 || s.IdleTimeout < 0 || s.ShutdownGrace < 0 {
+		return fmt.Errorf("timeouts and shutdown grace must not be negative")
+	}
+
+	settings := s.settings()
+	return settings.Validate()
+}
+
+func (s *Server) settings() server.Settings {
+	return server.Settings{
+		Bitrate:     s.Bitrate,
+		EgressCap:   s.EgressCap,
+		MaxConns:    s.MaxConns,
+		FaultRate:   s.FaultRate,
+		FaultStatus: s.FaultStatus,
+		AbortRate:   s.AbortRate,
+	}
 }
 
 func (s *Server) Run() error {
-	return server.RunServer(*s.Port, s.Bitrate, s.RandomBytes)
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	return server.RunServer(*s.Port, server.Options{
+		Settings:      s.settings(),
+		Content:       s.Content,
+		CompressRatio: s.CompressRatio,
+		RandomBytes:   s.RandomBytes,
+		Sendfile:      s.Sendfile,
+		Root:          s.Root,
+		StatusPath:    s.StatusPath,
+		AdminPath:     strings.TrimSuffix(s.AdminPath, "/"),
+		AdminToken:    s.AdminToken,
+		StatsInterval: s.StatsInterval,
+		EgressSharing: s.EgressSharing,
+		QueueConns:    s.QueueConns,
+		QueueTimeout:  s.QueueTimeout,
+
+		Pacing: server.Pacing{
+			Tick:          s.PaceTick,
+			FlushInterval: s.PaceFlushInterval,
+			CatchUp:       s.PaceCatchUp,
+		},
+
+		ReadHeaderTimeout: s.ReadHeaderTimeout,
+		IdleTimeout:       s.IdleTimeout,
+		ShutdownGrace:     s.ShutdownGrace,
+		DrainOnShutdown:   s.DrainOnShutdown,
+	}, ctx)
+}
+
+type Proxy struct {
+	Port        *int            `arg:"" env:"PORT" help:"Port to listen on"`
+	Upstream    *url.URL        `arg:"" env:"UPSTREAM_URL" help:"Origin URL to forward requests to, request path is appended to its path"`
+	Bitrate     bitrate.Bitrate `short:"b" env:"BITRATE" help:"Maximum bitrate for every response, if desired. Must have suffix of k, m or g"`
+	Latency     time.Duration   `env:"LATENCY" help:"Delay before sending response headers"`
+	Jitter      time.Duration   `env:"JITTER" help:"Maximal random deviation from latency"`
+	FaultRate   float64         `env:"FAULT_RATE" help:"Probability (0 to 1) of responding with fault status instead of forwarding request"`
+	FaultStatus int             `env:"FAULT_STATUS" help:"Status code of injected faults, from 400 to 599" default:"503"`
+	AbortRate   float64         `env:"ABORT_RATE" help:"Probability (0 to 1) of cutting connection at random point of response body"`
+}
+
+func (p *Proxy) Validate() error {
+	if p.Port == nil {
+		return nil
+	}
+
+	if *p.Port <= 0 {
+		return fmt.Errorf("port must be positive")
+	}
+
+	if *p.Port > 65535 {
+		return fmt.Errorf("port must be less than 65536")
+	}
+
+	if p.Upstream.Scheme != "http" && p.Upstream.Scheme != "https" {
+		return fmt.Errorf("upstream URL must be http or https")
+	}
+
+	if p.Latency < 0 || p.Jitter < 0 {
+		return fmt.Errorf("latency and jitter must not be negative")
+	}
+
+	if p.Jitter > p.Latency {
+		return fmt.Errorf("jitter must not exceed latency")
+	}
+
+	if p.FaultRate < 0 || p.FaultRate > 1 || p.AbortRate < 0 || p.AbortRate > 1 {
+		return fmt.Errorf("fault and abort rates must be in range from 0 to 1")
+	}
+
+	if p.FaultStatus < 400 || p.FaultStatus > 599 {
+		return fmt.Errorf("fault status must be HTTP error status code, from 400 to 599")
+	}
+
+	return nil
+}
+
+func (p *Proxy) Run() error {
+	return proxy.RunProxy(*p.Port, p.Upstream, proxy.Options{
+		Bitrate:     p.Bitrate,
+		Latency:     p.Latency,
+		Jitter:      p.Jitter,
+		FaultRate:   p.FaultRate,
+		FaultStatus: p.FaultStatus,
+		AbortRate:   p.AbortRate,
+	})
 }
 
 func main() {
@@ -110,7 +649,11 @@ func main() {
 
 	var cli struct {
 		Tester *Tester `cmd:"" default:"withargs" help:"Emulate video streaming at given bitrate to stress test you internet connection to given URL"`
-		Server *Server `cmd:"" help:"Run server which outputs random bytes to any connecting client"`
+		Server *Server `cmd:"" help:"Run server which outputs random bytes, or files from --root, to any connecting client"`
+		Proxy  *Proxy  `cmd:"" help:"Run proxy which forwards requests to origin, limiting bandwidth and injecting latency and faults"`
+
+		BenchViewers *BenchViewers `cmd:"" help:"Measure how tester memory and CPU usage grow with number of viewers"`
+		BenchGen     *BenchGen     `cmd:"" help:"Measure how fast server content sources produce bytes, without network"`
 	}
 
 	ctx := kong.Parse(&cli,
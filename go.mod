@@ -2,7 +2,4 @@ module dst
 
 go 1.22
 
-require (
-	github.com/alecthomas/kong v0.9.0
-	golang.org/x/sync v0.7.0
-)
+require github.com/alecthomas/kong v0.9.0
@@ -1,8 +1,10 @@
 package bitrate
 
 import (
+	"bufio"
 	"bytes"
 	"fmt"
+	"io"
 	"strconv"
 )
 
@@ -10,6 +12,12 @@ import (
 type Bitrate int
 
 func (b *Bitrate) UnmarshalText(text []byte) error {
+	if string(text) == "0" {
+		// Means no limit for those who accept it
+		*b = 0
+		return nil
+	}
+
 	var multiplier int
 	text = bytes.ToLower(text)
 	if bytes.HasSuffix(text, []byte("k")) {
@@ -34,3 +42,54 @@ func (b *Bitrate) UnmarshalText(text []byte) error {
 	*b = Bitrate(multiplier * br / 8)
 	return nil
 }
+
+// String formats bitrate the way UnmarshalText accepts it, rounding down to whole kilobits
+func (b Bitrate) String() string {
+	bits := int64(b) * 8
+	switch {
+	case bits == 0:
+		return "0"
+	case bits%(1<<30) == 0:
+		return fmt.Sprintf("%dg", bits>>30)
+	case bits%(1<<20) == 0:
+		return fmt.Sprintf("%dm", bits>>20)
+	default:
+		return fmt.Sprintf("%dk", bits>>10)
+	}
+}
+
+func (b Bitrate) MarshalText() ([]byte, error) {
+	return []byte(b.String()), nil
+}
+
+// ReadTrace reads bitrate trace, one bitrate per line in the same format as flags take.
+// Empty lines and lines starting with # are skipped.
+func ReadTrace(r io.Reader) ([]Bitrate, error) {
+	var trace []Bitrate
+
+	s := bufio.NewScanner(r)
+	for line := 1; s.Scan(); line++ {
+		text := bytes.TrimSpace(s.Bytes())
+		if len(text) == 0 || text[0] == '#' {
+			continue
+		}
+
+		var b Bitrate
+		if err := b.UnmarshalText(text); err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		if b == 0 {
+			return nil, fmt.Errorf("line %d: bitrate must be positive", line)
+		}
+		trace = append(trace, b)
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(trace) == 0 {
+		return nil, fmt.Errorf("trace is empty")
+	}
+
+	return trace, nil
+}
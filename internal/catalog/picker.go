@@ -0,0 +1,192 @@
+package catalog
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// Options tune how Picker spreads viewers. Zero value means defaults.
+type Options struct {
+	// Weights of URL templates, one per template. By default templates are picked evenly.
+	Weights []float64
+	// Catalog holds values for {catalog} placeholder
+	Catalog []string
+	// Objects is how many distinct values {seq} and {random} placeholders take
+	Objects int
+	// Popularity is how {catalog} and {random} values are drawn, catalog lines are ranked by their order.
+	// Default is uniform. Exponent is only used by Zipf distribution.
+	Popularity Popularity
+	Exponent   float64
+}
+
+// Picker picks URL for every new viewer: one of weighted templates with placeholders expanded.
+// Supported placeholders are:
+//
+//	{viewer}  number of the viewer
+//	{seq}     sequential number of the pick modulo Objects
+//	{random}  random number below Objects, drawn by Popularity
+//	{catalog} random value of Catalog, drawn by Popularity
+//
+// Safe for concurrent use from different goroutines.
+type Picker struct {
+	templates []string
+	// Cumulative weights of templates, nil if they are even
+	cumWeights []float64
+	catalog    []string
+	objects    int
+	allHTTPS   bool
+
+	catalogDist distribution
+	objectsDist distribution
+
+	seq atomic.Int64
+}
+
+// NewPicker checks that every template expands to absolute http(s) URL with any values of placeholders
+func NewPicker(templates []string, opts Options) (*Picker, error) {
+	if len(templates) == 0 {
+		return nil, fmt.Errorf("at least one URL is required")
+	}
+
+	if opts.Objects < 1 {
+		opts.Objects = 1
+	}
+
+	p := &Picker{
+		templates: templates,
+		catalog:   opts.Catalog,
+		objects:   opts.Objects,
+		allHTTPS:  true,
+
+		objectsDist: newDistribution(opts.Popularity, opts.Exponent, opts.Objects),
+	}
+	if len(p.catalog) > 0 {
+		p.catalogDist = newDistribution(opts.Popularity, opts.Exponent, len(p.catalog))
+	}
+
+	if len(opts.Weights) > 0 {
+		if len(opts.Weights) != len(templates) {
+			return nil, fmt.Errorf("got %d weights for %d URLs", len(opts.Weights), len(templates))
+		}
+
+		var sum float64
+		for _, w := range opts.Weights {
+			if w <= 0 {
+				return nil, fmt.Errorf("weights must be positive")
+			}
+
+			sum += w
+			p.cumWeights = append(p.cumWeights, sum)
+		}
+	}
+
+	for _, t := range templates {
+		values := []string{""}
+		if strings.Contains(t, "{catalog}") {
+			if len(p.catalog) == 0 {
+				return nil, fmt.Errorf("URL %q has {catalog} placeholder, but catalog is empty", t)
+			}
+			values = p.catalog
+		}
+
+		for _, v := range values {
+			u, err := parseURL(expand(t, 0, 0, 0, v))
+			if err != nil {
+				return nil, err
+			}
+
+			if u.Scheme != "https" {
+				p.allHTTPS = false
+			}
+		}
+	}
+
+	return p, nil
+}
+
+// Pick returns URL for the viewer with given number
+func (p *Picker) Pick(viewer int) *url.URL {
+	t := p.templates[0]
+	if p.cumWeights != nil {
+		x := rand.Float64() * p.cumWeights[len(p.cumWeights)-1]
+		t = p.templates[min(sort.SearchFloat64s(p.cumWeights, x), len(p.templates)-1)]
+	} else if len(p.templates) > 1 {
+		t = p.templates[rand.IntN(len(p.templates))]
+	}
+
+	var value string
+	if len(p.catalog) > 0 {
+		value = p.catalog[p.catalogDist.draw()]
+	}
+
+	seq := int(p.seq.Add(1)-1) % p.objects
+
+	u, err := parseURL(expand(t, viewer, seq, p.objectsDist.draw(), value))
+	if err != nil {
+		panic("impossible: URL template was checked, but expanded to bad URL: " + err.Error())
+	}
+
+	return u
+}
+
+// AllHTTPS tells whether all URLs Picker can return are https ones
+func (p *Picker) AllHTTPS() bool {
+	return p.allHTTPS
+}
+
+func expand(template string, viewer, seq, random int, value string) string {
+	if !strings.Contains(template, "{") {
+		return template
+	}
+
+	return strings.NewReplacer(
+		"{viewer}", strconv.Itoa(viewer),
+		"{seq}", strconv.Itoa(seq),
+		"{random}", strconv.Itoa(random),
+		"{catalog}", value,
+	).Replace(template)
+}
+
+func parseURL(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("bad URL %q: %v", s, err)
+	}
+
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return nil, fmt.Errorf("URL %q must be absolute http or https one", s)
+	}
+
+	return u, nil
+}
+
+// ReadCatalog reads catalog values, one per line. Empty lines and lines starting with # are skipped.
+func ReadCatalog(r io.Reader) ([]string, error) {
+	var values []string
+
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		values = append(values, line)
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(values) == 0 {
+		return nil, fmt.Errorf("catalog is empty")
+	}
+
+	return values, nil
+}
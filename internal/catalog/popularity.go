@@ -0,0 +1,59 @@
+package catalog
+
+import (
+	"math"
+	"math/rand/v2"
+	"sort"
+)
+
+// Popularity is distribution of viewers across catalog items, by their rank
+type Popularity string
+
+const (
+	// PopularityUniform makes all items equally popular
+	PopularityUniform Popularity = "uniform"
+	// PopularityZipf makes item of rank k popular proportionally to 1/k^s, where s is exponent.
+	// Video catalogs usually have exponent somewhere between 0.6 and 1.2.
+	PopularityZipf Popularity = "zipf"
+)
+
+// distribution draws rank of item, 0 being the most popular one
+type distribution interface {
+	draw() int
+}
+
+func newDistribution(p Popularity, exponent float64, n int) distribution {
+	if p != PopularityZipf || n < 2 {
+		return uniform(n)
+	}
+
+	return newZipf(exponent, n)
+}
+
+type uniform int
+
+func (u uniform) draw() int {
+	return rand.IntN(int(u))
+}
+
+// zipf keeps cumulative distribution, unlike rand.Zipf it supports exponents not exceeding 1
+type zipf struct {
+	cdf []float64
+}
+
+func newZipf(exponent float64, n int) *zipf {
+	z := &zipf{cdf: make([]float64, n)}
+
+	var sum float64
+	for k := range n {
+		sum += 1 / math.Pow(float64(k+1), exponent)
+		z.cdf[k] = sum
+	}
+
+	return z
+}
+
+func (z *zipf) draw() int {
+	x := rand.Float64() * z.cdf[len(z.cdf)-1]
+	return min(sort.SearchFloat64s(z.cdf, x), len(z.cdf)-1)
+}
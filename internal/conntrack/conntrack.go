@@ -0,0 +1,202 @@
+// Package conntrack tracks connections of http.Server: requests served over them, bytes written and
+// recent write rate. It is shared by server and proxy.
+package conntrack
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Tracker tracks open connections, each with extra state T of its user. Safe for concurrent use,
+// must not be copied after first use.
+type Tracker[T any] struct {
+	// OnState is optional, it is called on every state change of tracked connection, after it is recorded
+	OnState func(c *Conn[T], state http.ConnState)
+	// LogLevel is level closed connections are logged at
+	LogLevel slog.Level
+
+	conns    sync.Map
+	active   atomic.Int64
+	accepted atomic.Int64
+}
+
+// Conn is tracked connection
+type Conn[T any] struct {
+	RemoteAddr string
+	Start      time.Time
+	Requests   atomic.Int64
+	// Ext is extra state of tracker user
+	Ext T
+
+	conn    net.Conn
+	written atomic.Int64
+	recent  rateWindow
+	state   atomic.Int32
+	// Set by graceful close, so connection is closed once it is done with current requests
+	closeWhenIdle atomic.Bool
+}
+
+type connKey struct{}
+
+// ConnContext is meant for http.Server.ConnContext, it starts tracking the connection
+func (t *Tracker[T]) ConnContext(ctx context.Context, c net.Conn) context.Context {
+	tc := &Conn[T]{conn: c, RemoteAddr: c.RemoteAddr().String(), Start: time.Now()}
+	t.conns.Store(c, tc)
+	t.active.Add(1)
+	t.accepted.Add(1)
+
+	return context.WithValue(ctx, connKey{}, tc)
+}
+
+// ConnState is meant for http.Server.ConnState, it stops tracking closed connections
+func (t *Tracker[T]) ConnState(c net.Conn, state http.ConnState) {
+	if state != http.StateClosed && state != http.StateHijacked {
+		v, ok := t.conns.Load(c)
+		if !ok {
+			return
+		}
+
+		tc := v.(*Conn[T])
+		tc.state.Store(int32(state))
+		if state == http.StateIdle && tc.closeWhenIdle.Load() {
+			c.Close()
+		}
+		if t.OnState != nil {
+			t.OnState(tc, state)
+		}
+		return
+	}
+
+	v, ok := t.conns.LoadAndDelete(c)
+	if !ok {
+		return
+	}
+	t.active.Add(-1)
+
+	tc := v.(*Conn[T])
+	if t.OnState != nil {
+		t.OnState(tc, state)
+	}
+	slog.Log(context.Background(), t.LogLevel, "Connection closed", slog.String("remote_addr", tc.RemoteAddr),
+		slog.Int64("requests", tc.Requests.Load()), slog.Int64("bytes_written", tc.Written()),
+		slog.Duration("duration", time.Since(tc.Start)))
+}
+
+// FromContext returns connection request context belongs to, or nil if it is not tracked by t
+func (t *Tracker[T]) FromContext(ctx context.Context) *Conn[T] {
+	tc, _ := ctx.Value(connKey{}).(*Conn[T])
+	return tc
+}
+
+// Active is number of open connections
+func (t *Tracker[T]) Active() int64 {
+	return t.active.Load()
+}
+
+// Accepted is number of connections accepted since start
+func (t *Tracker[T]) Accepted() int64 {
+	return t.accepted.Load()
+}
+
+// Range calls f for every open connection, until it returns false
+func (t *Tracker[T]) Range(f func(c *Conn[T]) bool) {
+	t.conns.Range(func(_, v any) bool {
+		return f(v.(*Conn[T]))
+	})
+}
+
+// CloseAll closes all connections but the given one right away, or if gracefully, once they are idle.
+// Returns number of connections.
+func (t *Tracker[T]) CloseAll(gracefully bool, except *Conn[T]) int {
+	n := 0
+	t.Range(func(c *Conn[T]) bool {
+		if c == except {
+			return true
+		}
+		n++
+
+		if !gracefully {
+			c.conn.Close()
+			return true
+		}
+
+		c.closeWhenIdle.Store(true)
+		if state := http.ConnState(c.state.Load()); state == http.StateIdle || state == http.StateNew {
+			c.conn.Close()
+		}
+		return true
+	})
+
+	return n
+}
+
+// AddWritten counts bytes written to connection
+func (c *Conn[T]) AddWritten(n int64) {
+	c.written.Add(n)
+	c.recent.add(time.Since(c.Start), n)
+}
+
+// Written is number of bytes written to connection since it was opened
+func (c *Conn[T]) Written() int64 {
+	return c.written.Load()
+}
+
+// Throughput is average write rate since connection was opened, bytes per second
+func (c *Conn[T]) Throughput() float64 {
+	return float64(c.Written()) / time.Since(c.Start).Seconds()
+}
+
+// RecentRate is write rate over last few seconds, bytes per second
+func (c *Conn[T]) RecentRate() float64 {
+	return c.recent.rate(time.Since(c.Start))
+}
+
+// Seconds of rateWindow
+const rateSeconds = 5
+
+// rateWindow counts bytes written in every of last rateSeconds seconds of connection lifetime
+type rateWindow struct {
+	lock sync.Mutex
+	// Bytes of second s are at s % rateSeconds
+	buckets [rateSeconds]int64
+	// Last second bytes were added in
+	last int64
+}
+
+func (r *rateWindow) add(age time.Duration, n int64) {
+	sec := int64(age / time.Second)
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	// Seconds nothing was written in
+	for s := max(r.last+1, sec-rateSeconds+1); s <= sec; s++ {
+		r.buckets[s%rateSeconds] = 0
+	}
+	r.last = max(r.last, sec)
+	r.buckets[sec%rateSeconds] += n
+}
+
+// rate is average over the window ending at age, current second included
+func (r *rateWindow) rate(age time.Duration) float64 {
+	sec := int64(age / time.Second)
+	from := max(sec-rateSeconds+1, 0)
+
+	r.lock.Lock()
+	var total int64
+	for s := from; s <= min(r.last, sec); s++ {
+		total += r.buckets[s%rateSeconds]
+	}
+	r.lock.Unlock()
+
+	d := age - time.Duration(from)*time.Second
+	if d <= 0 {
+		return 0
+	}
+	return float64(total) / d.Seconds()
+}
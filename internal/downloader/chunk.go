@@ -0,0 +1,40 @@
+package downloader
+
+// ChunkStrategy controls how much of the content every range request asks for
+type ChunkStrategy string
+
+const (
+	// ChunkOpen asks for everything from the offset to the end, content is requested without range from the start
+	ChunkOpen ChunkStrategy = "open"
+	// ChunkFixed asks for ChunkSize bytes at a time, like many players do
+	ChunkFixed ChunkStrategy = "fixed"
+	// ChunkAdaptive asks for as much as consumer buffer lacks, but at least ChunkSize bytes
+	ChunkAdaptive ChunkStrategy = "adaptive"
+)
+
+// Deficit tells how many bytes consumer needs to fill its buffer, used by adaptive chunk strategy
+type Deficit = func() int64
+
+// chunkEnd returns last byte of the chunk to request from offset, negative for open-ended range
+func (d *Downloader) chunkEnd(offset int64) int64 {
+	var size int64
+	switch d.chunkStrategy {
+	case ChunkFixed:
+		size = d.chunkSize
+	case ChunkAdaptive:
+		size = d.chunkSize
+		if d.deficit != nil {
+			size = max(size, d.deficit())
+		}
+	}
+	if size <= 0 {
+		return -1
+	}
+
+	end := offset + size - 1
+	if d.remoteInfo != nil && d.remoteInfo.contentLength >= 0 {
+		end = min(end, d.remoteInfo.contentLength-1)
+	}
+
+	return end
+}
@@ -0,0 +1,211 @@
+package downloader
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Dialer establishes TCP connections for downloaders. Every downloader gets its own sequence number,
+// which is used to spread them round-robin across multiple addresses. Must be used by pointer.
+type Dialer struct {
+	// Resolve maps host:port to addresses to connect to instead, like curl's --resolve
+	Resolve map[string][]string
+	// Resolver is used to look up host names, nil means system default
+	Resolver *net.Resolver
+	// RoundRobin spreads downloaders across all addresses the host resolves to,
+	// instead of letting every one of them connect to the first reachable
+	RoundRobin bool
+	// LocalAddrs are source addresses to bind connections to, downloaders are spread across them round-robin
+	LocalAddrs []net.IP
+	// Links are emulated on every connection, downloaders are spread across them round-robin
+	Links []*LinkProfile
+
+	seq atomic.Uint64
+}
+
+// ParseResolve parses entry in curl's format host:port:addr[,addr]... and adds it to Resolve map
+func (d *Dialer) ParseResolve(entry string) error {
+	parts := strings.SplitN(entry, ":", 3)
+	if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+		return fmt.Errorf("resolve entry must be in form of host:port:addr[,addr]..., got %q", entry)
+	}
+
+	var addrs []string
+	for _, addr := range strings.Split(parts[2], ",") {
+		addr = strings.TrimSuffix(strings.TrimPrefix(strings.TrimSpace(addr), "["), "]")
+		if net.ParseIP(addr) == nil {
+			return fmt.Errorf("resolve entry address must be IP, got %q", addr)
+		}
+		addrs = append(addrs, net.JoinHostPort(addr, parts[1]))
+	}
+
+	if d.Resolve == nil {
+		d.Resolve = make(map[string][]string)
+	}
+	key := net.JoinHostPort(parts[0], parts[1])
+	d.Resolve[key] = append(d.Resolve[key], addrs...)
+
+	return nil
+}
+
+// AddInterface adds all global unicast addresses of the network interface to LocalAddrs
+func (d *Dialer) AddInterface(name string) error {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return err
+	}
+
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return fmt.Errorf("cannot list addresses of interface %s: %v", name, err)
+	}
+
+	found := false
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.IsGlobalUnicast() {
+			d.LocalAddrs = append(d.LocalAddrs, ipNet.IP)
+			found = true
+		}
+	}
+
+	if !found {
+		return fmt.Errorf("interface %s has no global unicast addresses", name)
+	}
+
+	return nil
+}
+
+// UseDNSServer makes dialer resolve host names by querying given DNS server (ip:port) directly
+func (d *Dialer) UseDNSServer(server string) {
+	d.Resolver = &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return (&net.Dialer{Timeout: 10 * time.Second}).DialContext(ctx, network, server)
+		},
+	}
+}
+
+type dialFunc = func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// dialContext returns dial function for the next downloader, bound to its sequence number.
+// If perConnection is set, every dialed connection takes its own sequence number instead,
+// which is what transports shared by many downloaders need.
+func (d *Dialer) dialContext(perConnection bool) dialFunc {
+	var seq uint64
+	if !perConnection {
+		seq = d.seq.Add(1) - 1
+	}
+
+	nd := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Resolver:  d.Resolver,
+	}
+
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		n := seq
+		if perConnection {
+			n = d.seq.Add(1) - 1
+		}
+
+		addrs := d.Resolve[addr]
+		if len(addrs) == 0 && d.RoundRobin {
+			var err error
+			addrs, err = d.lookup(ctx, addr)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		// Remote address takes the lowest digit of n, and local address the next one, so every local address
+		// talks to every remote one
+		rest := n
+		if len(addrs) > 0 {
+			addr = addrs[rest%uint64(len(addrs))]
+			rest /= uint64(len(addrs))
+		}
+
+		dialer := nd
+		if len(d.LocalAddrs) > 0 {
+			// Copy, because transport may dial concurrently
+			withLocal := *nd
+			var local net.IP
+			local, rest = d.localAddrFor(rest, addr)
+			withLocal.LocalAddr = &net.TCPAddr{IP: local}
+			dialer = &withLocal
+		}
+
+		c, err := dialer.DialContext(ctx, network, addr)
+		if err != nil || len(d.Links) == 0 {
+			return c, err
+		}
+
+		// Link takes the digit after addresses, so every remote address is reached over every link
+		lc, err := newLinkConn(ctx, c, d.Links[rest%uint64(len(d.Links))])
+		if err != nil {
+			return nil, err
+		}
+
+		return lc, nil
+	}
+}
+
+// localAddrFor picks n-th source address, of the same family as remote address if it is known.
+// Also returns what is left of n for further choices.
+func (d *Dialer) localAddrFor(n uint64, remote string) (net.IP, uint64) {
+	candidates := d.LocalAddrs
+
+	host, _, err := net.SplitHostPort(remote)
+	if ip := net.ParseIP(host); err == nil && ip != nil {
+		isV4 := ip.To4() != nil
+		candidates = make([]net.IP, 0, len(d.LocalAddrs))
+		for _, local := range d.LocalAddrs {
+			if (local.To4() != nil) == isV4 {
+				candidates = append(candidates, local)
+			}
+		}
+
+		if len(candidates) == 0 {
+			// Let dialer fail with meaningful error
+			candidates = d.LocalAddrs
+		}
+	}
+
+	return candidates[n%uint64(len(candidates))], n / uint64(len(candidates))
+}
+
+func (d *Dialer) lookup(ctx context.Context, addr string) ([]string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if net.ParseIP(host) != nil {
+		return nil, nil
+	}
+
+	r := d.Resolver
+	if r == nil {
+		r = net.DefaultResolver
+	}
+
+	ips, err := r.LookupHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	// DNS servers tend to rotate records, but we want stable assignment
+	slices.Sort(ips)
+
+	addrs := make([]string, len(ips))
+	for i, ip := range ips {
+		addrs[i] = net.JoinHostPort(ip, port)
+	}
+
+	return addrs, nil
+}
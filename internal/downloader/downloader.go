@@ -2,13 +2,17 @@ package downloader
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
-	"net"
 	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"dst/internal/logger"
@@ -21,11 +25,56 @@ import (
 // The function MUST be very fast, so nothing async please, and minimum allocations.
 type Consumer = func([]byte) (needMore bool)
 
+// Options tune how Downloader connects to the remote. Zero value means defaults.
+// Options are shared by all downloaders and MUST NOT be copied after first use.
+type Options struct {
+	// Dialer, if set, is used to establish connections, otherwise default dialer is used
+	Dialer    *Dialer
+	TLSConfig *tls.Config
+	// Header is sent with every request. Host header, if present, overrides request host.
+	Header http.Header
+	// CookieJar makes every downloader keep cookies set by the server between its requests
+	CookieJar bool
+	// Signer, if set, re-signs URL before every request
+	Signer *URLSigner
+	// ConnectionMode controls how downloaders share connections, default is dedicated
+	ConnectionMode ConnectionMode
+	// StreamsPerConnection is how many downloaders share single connection in HTTP/2 mode
+	StreamsPerConnection int
+	// Segments, if more than 1, makes downloader fetch content by this many concurrent range requests
+	// of SegmentSize bytes each, like download managers do. Needs ranges support and known content length,
+	// otherwise single request is used.
+	Segments    int
+	SegmentSize int64
+	// ChunkStrategy controls how much every range request asks for, default is open-ended.
+	// ChunkSize is size of fixed chunks, or minimal size of adaptive ones.
+	ChunkStrategy ChunkStrategy
+	ChunkSize     int64
+	// Reconnect makes every request go over new connection, and paused download drop its response
+	// instead of keeping it open until resume
+	Reconnect bool
+
+	transports transportPool
+}
+
+// Read buffers are only held while download is active, paused downloaders return them to the pool
+var bufPool = sync.Pool{
+	New: func() any {
+		// Align with transport read buffer of 16K
+		buf := make([]byte, 16<<10)
+		return &buf
+	},
+}
+
 type remoteInfo struct {
 	rangesSupported bool
-	contentLength   int64
+	// Full length of the content (not just requested range), negative if unknown
+	contentLength int64
 }
 
+// Returned by readBody when seek was requested, body should be dropped
+var errSeek = errors.New("seek requested")
+
 // Downloader is simple single-thread download client. It MUST NOT be copied.
 // Safe for concurrent use from different goroutines.
 type Downloader struct {
@@ -34,11 +83,22 @@ type Downloader struct {
 
 	client     *http.Client
 	ctx        context.Context
+	url        *url.URL
+	signer     *URLSigner
 	req        *http.Request
 	remoteInfo *remoteInfo
 
-	respBody       io.ReadCloser
-	buf            []byte
+	segments      int
+	segmentSize   int64
+	chunkStrategy ChunkStrategy
+	chunkSize     int64
+	deficit       Deficit
+	reconnect     bool
+	// Whether current request asked for a chunk rather than the rest of content
+	chunked bool
+
+	respBody io.ReadCloser
+	// Offset of the next byte to download, which is not necessarily number of bytes downloaded after seeks
 	consumedLength int64
 
 	lock      sync.Locker
@@ -46,12 +106,19 @@ type Downloader struct {
 	isRunning bool
 	err       error
 	closed    bool
+	// Checked by running download on every read, the offset itself is guarded by lock
+	seekPending atomic.Bool
+	seekTo      int64
 }
 
 // StartNewDownloader will create new downloader instance and return it.
 // It will initiate download process in the background, so consumer must be ready to handle
-// incoming data immediately.
-func StartNewDownloader(url *url.URL, consumer Consumer, ctx context.Context, logger *slog.Logger) *Downloader {
+// incoming data immediately. Deficit is only needed for adaptive chunk strategy and may be nil.
+func StartNewDownloader(url *url.URL, opts *Options, consumer Consumer, deficit Deficit, ctx context.Context, logger *slog.Logger) *Downloader {
+	if opts == nil {
+		opts = &Options{}
+	}
+
 	if ctx == nil {
 		ctx = context.Background()
 	}
@@ -63,35 +130,19 @@ func StartNewDownloader(url *url.URL, consumer Consumer, ctx context.Context, lo
 	d := &Downloader{
 		consumer: consumer,
 		logger:   logger,
-		client: &http.Client{
-			// Copy definition of DefaultTransport, because I want dedicated connection pools for every client
-			Transport: &http.Transport{
-				Proxy: http.ProxyFromEnvironment,
-				DialContext: (&net.Dialer{
-					Timeout:   30 * time.Second,
-					KeepAlive: 30 * time.Second,
-				}).DialContext,
-				ForceAttemptHTTP2:     true,
-				MaxIdleConns:          100,
-				IdleConnTimeout:       90 * time.Second,
-				TLSHandshakeTimeout:   10 * time.Second,
-				ExpectContinueTimeout: 1 * time.Second,
-				// Align with our own buffer of 16K
-				ReadBufferSize: 16 << 10,
-			},
-		},
-		ctx: ctx,
-		// Template request, only Ranges header may be changed before sending
-		req: (&http.Request{
-			Method:     "GET",
-			URL:        url,
-			Proto:      "HTTP/1.1",
-			ProtoMajor: 1,
-			ProtoMinor: 1,
-			Header:     make(http.Header),
-			Host:       url.Host,
-		}).Clone(ctx),
-		buf:     make([]byte, 16<<10),
+		client:   opts.NewClient(),
+		ctx:      ctx,
+		url:      url,
+		signer:   opts.Signer,
+
+		segments:      opts.Segments,
+		segmentSize:   opts.SegmentSize,
+		chunkStrategy: opts.ChunkStrategy,
+		chunkSize:     opts.ChunkSize,
+		deficit:       deficit,
+		reconnect:     opts.Reconnect,
+		// Template request, only Ranges header and URL (when signing) may be changed before sending
+		req:     opts.NewRequest(url, ctx),
 		lock:    &sync.Mutex{},
 		closedC: make(chan struct{}),
 	}
@@ -104,6 +155,9 @@ func StartNewDownloader(url *url.URL, consumer Consumer, ctx context.Context, lo
 
 // At most one thread can be running at any given time (use synchronization)
 func (d *Downloader) run() {
+	buf := bufPool.Get().(*[]byte)
+	defer bufPool.Put(buf)
+
 	cont := true
 
 	for cont {
@@ -114,14 +168,24 @@ func (d *Downloader) run() {
 
 		var n int64
 		var err error
-		n, cont, err = d.readBody(body)
+		n, cont, err = d.readBody(body, *buf)
 		d.consumedLength += n
+		if err == errSeek {
+			body.Close()
+
+			d.lock.Lock()
+			d.applySeekLocked()
+			d.lock.Unlock()
+
+			cont = true
+			continue
+		}
 		if err == io.EOF {
 			body.Close()
 
-			// only case when EOF is not the end of media - is we asked for range without knowing the full size of file
-			if d.req.Header.Get("Range") != "" &&
-				d.remoteInfo.contentLength < 0 &&
+			// only case when EOF is not the end of media - is we asked for a chunk, not the rest of file
+			if d.chunked &&
+				(d.remoteInfo.contentLength < 0 || d.consumedLength < d.remoteInfo.contentLength) &&
 				n > 0 {
 
 				continue
@@ -142,25 +206,53 @@ func (d *Downloader) run() {
 			panic("impossible: readBody returned without error (even EOF) and with positive cont")
 		}
 
-		d.respBody = body
+		if d.reconnect {
+			// Next request will go over new connection anyway
+			body.Close()
+		} else {
+			d.respBody = body
+		}
 	}
 
 	d.lock.Lock()
 	defer d.lock.Unlock()
 
+	if d.seekPending.Load() {
+		// Seek came in when we were about to pause, consumer will want new data right away
+		d.applySeekLocked()
+		go d.run()
+		return
+	}
+
 	d.logger.Debug("Pause download")
 
 	d.isRunning = false
 }
 
-func (d *Downloader) readBody(body io.ReadCloser) (int64, bool, error) {
+// applySeekLocked drops current response, so next request starts from seek offset.
+// Must be called under lock when download is not running or by the running thread itself.
+func (d *Downloader) applySeekLocked() {
+	if d.respBody != nil {
+		d.respBody.Close()
+		d.respBody = nil
+	}
+
+	d.consumedLength = d.seekTo
+	d.seekPending.Store(false)
+	d.logger.Debug("Seek download", slog.Int64("offset", d.seekTo))
+}
+
+func (d *Downloader) readBody(body io.ReadCloser, buf []byte) (int64, bool, error) {
 	var n int64 = 0
 
 	for {
 		var cont bool
-		n_, err := body.Read(d.buf)
+		n_, err := body.Read(buf)
+		if d.seekPending.Load() {
+			return n, false, errSeek
+		}
 		if n_ > 0 {
-			cont = d.consumer(d.buf[:n_])
+			cont = d.consumer(buf[:n_])
 		}
 		n += int64(n_)
 
@@ -214,49 +306,161 @@ func (d *Downloader) getResponseBody() io.ReadCloser {
 	}
 
 	range_ := ""
+	d.chunked = false
 
-	if d.consumedLength > 0 {
-		if !d.remoteInfo.rangesSupported {
-			d.lockAndSetError(fmt.Errorf("cannot continue download because ranges are not supported"))
-			return nil
-		}
+	if d.segments > 1 && d.remoteInfo == nil {
+		// Learn content length by requesting the first segment alone
+		range_ = fmt.Sprintf("%d-%d", d.consumedLength, d.consumedLength+d.segmentSize-1)
+		d.req.Header.Set("Range", "bytes="+range_)
+		d.chunked = true
+	} else if d.segments > 1 && d.remoteInfo.rangesSupported && d.remoteInfo.contentLength >= 0 &&
+		d.consumedLength < d.remoteInfo.contentLength {
+
+		d.logger.Debug("Start segmented download", slog.Int64("offset", d.consumedLength),
+			slog.Int("segments", d.segments))
+		return newSegmentedBody(d, d.consumedLength, d.remoteInfo.contentLength)
+	} else if d.consumedLength > 0 || d.chunkStrategy == ChunkFixed || d.chunkStrategy == ChunkAdaptive {
+		if d.consumedLength > 0 && d.remoteInfo != nil {
+			if !d.remoteInfo.rangesSupported {
+				d.lockAndSetError(fmt.Errorf("cannot continue download because ranges are not supported"))
+				return nil
+			}
 
-		if d.remoteInfo.contentLength >= 0 {
-			if d.consumedLength >= d.remoteInfo.contentLength {
+			if d.remoteInfo.contentLength >= 0 && d.consumedLength >= d.remoteInfo.contentLength {
 				d.lockAndSetError(fmt.Errorf("cannot continue download because already consumed all content"))
 				return nil
 			}
+		}
 
-			range_ = fmt.Sprintf("%d-%d", d.consumedLength, d.remoteInfo.contentLength-1)
-		} else {
-			range_ = fmt.Sprintf("%d-%d", d.consumedLength, d.consumedLength+100*1048576)
+		range_ = fmt.Sprintf("%d-", d.consumedLength)
+		if end := d.chunkEnd(d.consumedLength); end >= 0 {
+			range_ += strconv.FormatInt(end, 10)
+			d.chunked = true
+		} else if d.remoteInfo != nil && d.remoteInfo.contentLength >= 0 {
+			range_ += strconv.FormatInt(d.remoteInfo.contentLength-1, 10)
 		}
 		d.req.Header.Set("Range", "bytes="+range_)
+	} else {
+		// Might be left from before seek to the start
+		d.req.Header.Del("Range")
+	}
+
+	if d.signer != nil {
+		d.req.URL = d.signer.Sign(d.url, time.Now())
 	}
 
 	d.logger.Debug("Making request", slog.String("range", range_))
 
-	resp, err := d.client.Do(d.req)
+	req := d.req
+	if d.client.Jar != nil {
+		// Client adds cookies from the jar directly to the request headers, so keep template intact
+		req = req.Clone(d.ctx)
+	}
+
+	resp, err := d.client.Do(req)
 	if err != nil {
 		d.lockAndSetError(err)
 		return nil
 	}
 
-	d.remoteInfo = &remoteInfo{
+	info := &remoteInfo{
 		rangesSupported: resp.Header.Get("Accept-Ranges") == "bytes",
 		contentLength:   resp.ContentLength,
 	}
 
-	if resp.StatusCode != 200 {
+	switch {
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable && range_ != "" && d.consumedLength > 0:
+		// Seek or chunk went past the end of content, which length was not known
+		resp.Body.Close()
+		info.rangesSupported = true
+		info.contentLength = parseContentRangeLength(resp.Header.Get("Content-Range"))
+
+		d.lock.Lock()
+		d.remoteInfo = info
+		d.lock.Unlock()
+
+		d.logger.Info("Download complete, offset is past the end of content", slog.Int64("offset", d.consumedLength))
+		d.lockAndSaveFinished()
+		return nil
+	case resp.StatusCode == http.StatusPartialContent && range_ != "":
+		// Server would not bother with Accept-Ranges in response to successful range request
+		info.rangesSupported = true
+		info.contentLength = parseContentRangeLength(resp.Header.Get("Content-Range"))
+	case resp.StatusCode != http.StatusOK:
+		resp.Body.Close()
 		d.lockAndSetError(fmt.Errorf("bad status code: %d", resp.StatusCode))
 		return nil
+	case range_ != "":
+		// Content is coming from the start then, but we only count bytes anyway
+		d.logger.Debug("Server ignored range request")
 	}
 
-	d.logger.Debug("Got response", slog.Bool("ranges_supported", d.remoteInfo.rangesSupported))
+	d.lock.Lock()
+	d.remoteInfo = info
+	d.lock.Unlock()
+
+	d.logger.Debug("Got response", slog.String("proto", resp.Proto),
+		slog.Bool("ranges_supported", d.remoteInfo.rangesSupported))
 
 	return resp.Body
 }
 
+// parseContentRangeLength extracts full length from header like "bytes 0-99/1000", negative if unknown
+func parseContentRangeLength(contentRange string) int64 {
+	_, total, ok := strings.Cut(contentRange, "/")
+	if !ok {
+		return -1
+	}
+
+	length, err := strconv.ParseInt(total, 10, 64)
+	if err != nil {
+		return -1
+	}
+
+	return length
+}
+
+// ContentLength returns full length of the content, negative if it is not known (yet)
+func (d *Downloader) ContentLength() int64 {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.remoteInfo == nil {
+		return -1
+	}
+
+	return d.remoteInfo.contentLength
+}
+
+// SeekTo makes download continue from given offset, dropping data of the current response.
+// Data, which is already being passed to consumer, may still arrive after Seek returns.
+// Paused download is resumed, and completed one is started again from the offset, like player does
+// when seeking back after the end. Returns false if download has failed.
+func (d *Downloader) SeekTo(offset int64) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.err != nil {
+		return false
+	}
+
+	if d.closed {
+		d.closed = false
+		d.closedC = make(chan struct{})
+	}
+
+	d.seekTo = offset
+	d.seekPending.Store(true)
+
+	if !d.isRunning {
+		d.applySeekLocked()
+		d.isRunning = true
+		go d.run()
+	}
+
+	return true
+}
+
 func (d *Downloader) Resume() bool {
 	d.lock.Lock()
 	defer d.lock.Unlock()
@@ -271,7 +475,12 @@ func (d *Downloader) Resume() bool {
 	return true
 }
 
+// WaitC returns channel which is closed once download is over. Seek after that starts download again,
+// with new channel.
 func (d *Downloader) WaitC() chan struct{} {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
 	return d.closedC
 }
 
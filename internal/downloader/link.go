@@ -0,0 +1,271 @@
+package downloader
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"dst/internal/bitrate"
+)
+
+// LinkProfile describes last-mile link of a viewer, which is emulated on connection level
+type LinkProfile struct {
+	// Bandwidth caps download speed, 0 means unlimited
+	Bandwidth bitrate.Bitrate
+	// Latency is added once per request-response round trip, Jitter is maximal random deviation from it
+	Latency time.Duration
+	Jitter  time.Duration
+	// Loss is probability (0 to 1) of every 1500-byte packet getting lost, which stalls download
+	// for retransmission timeout
+	Loss float64
+}
+
+// LinkProfiles are well-known link types
+var LinkProfiles = map[string]LinkProfile{
+	"3g":    {Bandwidth: 1536 << 10 / 8, Latency: 150 * time.Millisecond, Jitter: 50 * time.Millisecond, Loss: 0.001},
+	"lte":   {Bandwidth: 12 << 20 / 8, Latency: 60 * time.Millisecond, Jitter: 20 * time.Millisecond, Loss: 0.0005},
+	"cable": {Bandwidth: 50 << 20 / 8, Latency: 20 * time.Millisecond, Jitter: 5 * time.Millisecond, Loss: 0.0001},
+}
+
+// ParseLinkProfile accepts either name of the well-known profile,
+// or custom one in form of bw=2m,latency=100ms,jitter=20ms,loss=0.001 (all keys are optional)
+func ParseLinkProfile(s string) (*LinkProfile, error) {
+	if p, ok := LinkProfiles[strings.ToLower(s)]; ok {
+		return &p, nil
+	}
+
+	var p LinkProfile
+	for _, kv := range strings.Split(s, ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(kv), "=")
+		if !ok {
+			return nil, fmt.Errorf("link profile must be one of 3g, lte, cable or list of key=value, got %q", s)
+		}
+
+		var err error
+		switch key {
+		case "bw":
+			err = p.Bandwidth.UnmarshalText([]byte(value))
+		case "latency":
+			p.Latency, err = time.ParseDuration(value)
+		case "jitter":
+			p.Jitter, err = time.ParseDuration(value)
+		case "loss":
+			p.Loss, err = strconv.ParseFloat(value, 64)
+			if err == nil && (p.Loss < 0 || p.Loss >= 1) {
+				err = fmt.Errorf("must be in range [0, 1)")
+			}
+		default:
+			return nil, fmt.Errorf("unknown link profile key %q, must be one of bw, latency, jitter, loss", key)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("bad link profile %s: %v", key, err)
+		}
+	}
+
+	if p.Jitter > p.Latency {
+		return nil, fmt.Errorf("link jitter must not exceed latency")
+	}
+
+	return &p, nil
+}
+
+func (p *LinkProfile) roundTripDelay() time.Duration {
+	if p.Jitter == 0 {
+		return p.Latency
+	}
+
+	return p.Latency - p.Jitter + rand.N(2*p.Jitter+1)
+}
+
+// queueSize is how many chunks may be in flight over the link: twice its bandwidth-delay product,
+// or plenty if bandwidth is unlimited
+func (p *LinkProfile) queueSize() int {
+	if p.Bandwidth == 0 {
+		return 64
+	}
+
+	bdp := float64(p.Bandwidth) * (p.Latency + p.Jitter).Seconds()
+	return int(2*bdp/linkChunkSize) + 4
+}
+
+// TCP would not retransmit sooner than in 200ms, and not sooner than round trip time
+func (p *LinkProfile) stallDuration() time.Duration {
+	return max(200*time.Millisecond, 2*p.Latency)
+}
+
+// Incoming data is read in chunks up to this size
+const linkChunkSize = 16 << 10
+
+// Chunk buffers are reused, as thousands of connections would keep garbage collector busy otherwise
+var linkBufPool = sync.Pool{
+	New: func() any {
+		buf := make([]byte, linkChunkSize)
+		return &buf
+	},
+}
+
+// linkConn emulates link profile on top of real connection. Latency delays incoming data, so it applies
+// once per request-response exchange, while data already streaming flows at full bandwidth regardless
+// of what client writes meanwhile (like HTTP/2 window updates). Transport never does concurrent reads.
+type linkConn struct {
+	net.Conn
+	p *LinkProfile
+
+	// Incoming data with time it gets over the link, read in the background
+	chunks  chan linkChunk
+	current linkChunk
+	// Closed on Close, cancels all waits
+	closedC   chan struct{}
+	closeOnce sync.Once
+
+	pacedSince time.Time
+	paced      int
+}
+
+type linkChunk struct {
+	// Data not read yet, in buf which goes back to pool once it is read
+	data []byte
+	buf  *[]byte
+	err  error
+	at   time.Time
+}
+
+// newLinkConn waits for connection handshake to travel over the link, and starts emulating it
+func newLinkConn(ctx context.Context, c net.Conn, p *LinkProfile) (*linkConn, error) {
+	t := time.NewTimer(p.roundTripDelay())
+	defer t.Stop()
+
+	select {
+	case <-ctx.Done():
+		c.Close()
+		return nil, ctx.Err()
+	case <-t.C:
+	}
+
+	lc := &linkConn{Conn: c, p: p, chunks: make(chan linkChunk, p.queueSize()), closedC: make(chan struct{})}
+	go lc.receive()
+
+	return lc, nil
+}
+
+// receive reads incoming data and queues it to arrive after round trip delay
+func (c *linkConn) receive() {
+	// Data arrives in order, so jitter never lets chunk overtake the previous one
+	var last time.Time
+	for {
+		buf := linkBufPool.Get().(*[]byte)
+		n, err := c.Conn.Read(*buf)
+
+		at := time.Now().Add(c.p.roundTripDelay())
+		if at.Before(last) {
+			at = last
+		}
+		last = at
+
+		select {
+		case <-c.closedC:
+			linkBufPool.Put(buf)
+			return
+		case c.chunks <- linkChunk{data: (*buf)[:n], buf: buf, err: err, at: at}:
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (c *linkConn) Read(b []byte) (int, error) {
+	if len(c.current.data) == 0 && c.current.err == nil {
+		select {
+		case <-c.closedC:
+			return 0, net.ErrClosed
+		case c.current = <-c.chunks:
+		}
+
+		if !c.wait(time.Until(c.current.at)) {
+			return 0, net.ErrClosed
+		}
+	}
+
+	if len(c.current.data) == 0 {
+		if c.current.buf != nil {
+			linkBufPool.Put(c.current.buf)
+			c.current.buf = nil
+		}
+		return 0, c.current.err
+	}
+
+	if c.p.Bandwidth > 0 {
+		// Read in chunks of 20ms worth of data, so download does not come in big bursts
+		b = b[:min(len(b), max(int(c.p.Bandwidth)/50, 1500))]
+	}
+
+	n := copy(b, c.current.data)
+	c.current.data = c.current.data[n:]
+	if len(c.current.data) == 0 {
+		linkBufPool.Put(c.current.buf)
+		c.current.buf = nil
+	}
+
+	if c.p.Loss > 0 {
+		packets := (n + 1499) / 1500
+		if rand.Float64() < 1-math.Pow(1-c.p.Loss, float64(packets)) {
+			if !c.wait(c.p.stallDuration()) {
+				return n, net.ErrClosed
+			}
+			// Bandwidth credit is lost along with the packet
+			c.paced = 0
+		}
+	}
+
+	if c.p.Bandwidth > 0 {
+		now := time.Now()
+		if c.paced == 0 || now.After(c.pacedSince.Add(c.transferTime(c.paced)+100*time.Millisecond)) {
+			// Link was idle, which does not give credit to download faster later
+			c.pacedSince, c.paced = now, 0
+		}
+
+		c.paced += n
+		if !c.wait(time.Until(c.pacedSince.Add(c.transferTime(c.paced)))) {
+			return n, net.ErrClosed
+		}
+	}
+
+	return n, nil
+}
+
+func (c *linkConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closedC)
+	})
+
+	return c.Conn.Close()
+}
+
+// wait sleeps for d, unless connection is closed meanwhile, in which case it returns false.
+// Transport closes connection when request is cancelled, so this stops waits of cancelled requests.
+func (c *linkConn) wait(d time.Duration) bool {
+	if d <= 0 {
+		return true
+	}
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-c.closedC:
+		return false
+	case <-t.C:
+		return true
+	}
+}
+
+func (c *linkConn) transferTime(n int) time.Duration {
+	return time.Duration(int64(n) * int64(time.Second) / int64(c.p.Bandwidth))
+}
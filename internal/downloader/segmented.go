@@ -0,0 +1,138 @@
+package downloader
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// segment is a chunk of content fetched by its own range request
+type segment struct {
+	offset, length int64
+
+	doneC chan struct{}
+	data  []byte
+	err   error
+}
+
+// segmentedBody downloads content from given offset by concurrent range requests of fixed size,
+// and reads them back in order. At most `parallel` segments are in flight or waiting to be read,
+// so paused download holds no more than that in memory.
+// Read is not safe for concurrent use, same as response body.
+type segmentedBody struct {
+	d        *Downloader
+	ctx      context.Context
+	cancel   context.CancelFunc
+	parallel int
+	size     int64
+	length   int64
+
+	// Offset of the next segment to request
+	next  int64
+	queue []*segment
+	// Unread part of the first segment in the queue
+	unread []byte
+}
+
+func newSegmentedBody(d *Downloader, offset, length int64) *segmentedBody {
+	ctx, cancel := context.WithCancel(d.ctx)
+
+	b := &segmentedBody{
+		d:        d,
+		ctx:      ctx,
+		cancel:   cancel,
+		parallel: d.segments,
+		size:     d.segmentSize,
+		length:   length,
+		next:     offset,
+	}
+	b.fill()
+
+	return b
+}
+
+// fill starts fetching segments until there are enough of them queued
+func (b *segmentedBody) fill() {
+	for len(b.queue) < b.parallel && b.next < b.length {
+		s := &segment{
+			offset: b.next,
+			length: min(b.size, b.length-b.next),
+			doneC:  make(chan struct{}),
+		}
+		b.next += s.length
+		b.queue = append(b.queue, s)
+
+		go b.fetch(s)
+	}
+}
+
+func (b *segmentedBody) fetch(s *segment) {
+	defer close(s.doneC)
+
+	range_ := fmt.Sprintf("%d-%d", s.offset, s.offset+s.length-1)
+	b.d.logger.Debug("Making segment request", slog.String("range", range_))
+
+	req := b.d.req.Clone(b.ctx)
+	req.Header.Set("Range", "bytes="+range_)
+	if b.d.signer != nil {
+		req.URL = b.d.signer.Sign(b.d.url, time.Now())
+	}
+
+	resp, err := b.d.client.Do(req)
+	if err != nil {
+		s.err = err
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusPartialContent {
+		s.err = fmt.Errorf("bad status code of segment %s: %d", range_, resp.StatusCode)
+		return
+	}
+
+	s.data = make([]byte, s.length)
+	n, err := io.ReadFull(resp.Body, s.data)
+	if err != nil {
+		s.err = fmt.Errorf("error reading segment %s after %d bytes: %v", range_, n, err)
+	}
+}
+
+func (b *segmentedBody) Read(p []byte) (int, error) {
+	for len(b.unread) == 0 {
+		if len(b.queue) == 0 {
+			return 0, io.EOF
+		}
+
+		s := b.queue[0]
+		select {
+		case <-s.doneC:
+		case <-b.ctx.Done():
+			return 0, b.ctx.Err()
+		}
+
+		if s.err != nil {
+			return 0, s.err
+		}
+
+		b.unread = s.data
+		b.queue = b.queue[1:]
+		b.fill()
+	}
+
+	n := copy(p, b.unread)
+	b.unread = b.unread[n:]
+
+	return n, nil
+}
+
+// Close cancels segments in flight, their goroutines finish shortly after
+func (b *segmentedBody) Close() error {
+	b.cancel()
+	b.queue = nil
+	b.unread = nil
+
+	return nil
+}
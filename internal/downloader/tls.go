@@ -0,0 +1,130 @@
+package downloader
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// TLSOptions describe how downloader should set up TLS connections. Zero value means Go defaults.
+type TLSOptions struct {
+	// CAFile is PEM bundle with certificates which are trusted in addition to system ones
+	CAFile string
+	// Insecure disables server certificate verification entirely
+	Insecure bool
+	// CertFile and KeyFile are PEM client certificate and key for mutual TLS, both or none must be set
+	CertFile string
+	KeyFile  string
+	// ServerName overrides SNI (and the name which server certificate is verified against)
+	ServerName string
+	// MinVersion and MaxVersion are one of 1.0, 1.1, 1.2, 1.3
+	MinVersion string
+	MaxVersion string
+	// CipherSuites are names as reported by crypto/tls, only affect TLS 1.2 and below
+	CipherSuites []string
+}
+
+// Config builds tls.Config from options. Returns nil config if options are all default.
+func (o *TLSOptions) Config() (*tls.Config, error) {
+	if o == nil || o.isZero() {
+		return nil, nil
+	}
+
+	c := &tls.Config{
+		InsecureSkipVerify: o.Insecure,
+		ServerName:         o.ServerName,
+	}
+
+	if o.CAFile != "" {
+		pem, err := os.ReadFile(o.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read CA file: %v", err)
+		}
+
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA file %s", o.CAFile)
+		}
+		c.RootCAs = pool
+	}
+
+	if (o.CertFile == "") != (o.KeyFile == "") {
+		return nil, fmt.Errorf("client certificate and key must be set together")
+	}
+	if o.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot load client certificate: %v", err)
+		}
+		c.Certificates = []tls.Certificate{cert}
+	}
+
+	var err error
+	if c.MinVersion, err = parseTLSVersion(o.MinVersion); err != nil {
+		return nil, err
+	}
+	if c.MaxVersion, err = parseTLSVersion(o.MaxVersion); err != nil {
+		return nil, err
+	}
+	if c.MinVersion != 0 && c.MaxVersion != 0 && c.MinVersion > c.MaxVersion {
+		return nil, fmt.Errorf("minimal TLS version must not be greater than maximal")
+	}
+
+	if c.CipherSuites, err = parseCipherSuites(o.CipherSuites); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func (o *TLSOptions) isZero() bool {
+	return o.CAFile == "" && !o.Insecure && o.CertFile == "" && o.KeyFile == "" && o.ServerName == "" &&
+		o.MinVersion == "" && o.MaxVersion == "" && len(o.CipherSuites) == 0
+}
+
+func parseTLSVersion(v string) (uint16, error) {
+	switch v {
+	case "":
+		return 0, nil
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	default:
+		return 0, fmt.Errorf("TLS version must be one of: 1.0, 1.1, 1.2, 1.3")
+	}
+}
+
+func parseCipherSuites(names []string) ([]uint16, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	known := make(map[string]uint16)
+	for _, s := range tls.CipherSuites() {
+		known[s.Name] = s.ID
+	}
+	for _, s := range tls.InsecureCipherSuites() {
+		known[s.Name] = s.ID
+	}
+
+	ids := make([]uint16, 0, len(names))
+	for _, name := range names {
+		id, ok := known[strings.ToUpper(strings.TrimSpace(name))]
+		if !ok {
+			return nil, fmt.Errorf("unknown cipher suite: %s", name)
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, nil
+}
@@ -0,0 +1,187 @@
+package downloader
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// ConnectionMode controls how downloaders share connections to the remote
+type ConnectionMode string
+
+const (
+	// ConnectionDedicated gives every downloader its own connection pool
+	ConnectionDedicated ConnectionMode = "dedicated"
+	// ConnectionShared makes all downloaders use single pool of HTTP/1.1 connections,
+	// so idle connections are picked up by whichever downloader needs one
+	ConnectionShared ConnectionMode = "shared"
+	// ConnectionHTTP2 multiplexes downloaders over HTTP/2 connections, StreamsPerConnection at a time
+	ConnectionHTTP2 ConnectionMode = "h2"
+)
+
+type transportPool struct {
+	lock    sync.Mutex
+	current *http.Transport
+	users   int
+}
+
+// NewClient returns client with transport according to connection mode, and its own cookie jar if enabled.
+// Every call counts as new downloader for connection sharing and round-robin purposes.
+func (o *Options) NewClient() *http.Client {
+	var jar http.CookieJar
+	if o.CookieJar {
+		// Never fails without options
+		jar, _ = cookiejar.New(nil)
+	}
+
+	return &http.Client{
+		Transport: o.transport(),
+		Jar:       jar,
+	}
+}
+
+// NewRequest returns GET request with configured headers, URL is signed if signer is set
+func (o *Options) NewRequest(u *url.URL, ctx context.Context) *http.Request {
+	header := o.Header.Clone()
+	if header == nil {
+		header = make(http.Header)
+	}
+	host := u.Host
+	if h := header.Get("Host"); h != "" {
+		host = h
+		header.Del("Host")
+	}
+
+	if o.Signer != nil {
+		u = o.Signer.Sign(u, time.Now())
+	}
+
+	return (&http.Request{
+		Method:     "GET",
+		URL:        u,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     header,
+		Host:       host,
+		Close:      o.Reconnect,
+	}).Clone(ctx)
+}
+
+// transport returns transport for the next downloader according to connection mode
+func (o *Options) transport() *http.Transport {
+	switch o.ConnectionMode {
+	case ConnectionShared:
+		o.transports.lock.Lock()
+		defer o.transports.lock.Unlock()
+
+		if o.transports.current == nil {
+			o.transports.current = o.newTransport()
+		}
+
+		return o.transports.current
+	case ConnectionHTTP2:
+		o.transports.lock.Lock()
+		defer o.transports.lock.Unlock()
+
+		if o.transports.current == nil || o.transports.users >= max(o.StreamsPerConnection, 1) {
+			o.transports.current = o.newTransport()
+			o.transports.users = 0
+		}
+		o.transports.users++
+
+		return o.transports.current
+	default:
+		return o.newTransport()
+	}
+}
+
+func (o *Options) newTransport() *http.Transport {
+	var dial dialFunc
+	if o.Dialer != nil {
+		dial = o.Dialer.dialContext(o.ConnectionMode == ConnectionShared)
+	} else {
+		dial = (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext
+	}
+
+	// Copy definition of DefaultTransport, because I want dedicated connection pools for every client
+	t := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dial,
+		TLSClientConfig:       o.TLSConfig.Clone(),
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+		// Align with our own buffer of 16K
+		ReadBufferSize: 16 << 10,
+	}
+
+	if o.Segments > 1 {
+		// Keep connections of segment requests alive between segments
+		t.MaxIdleConnsPerHost = o.Segments
+	}
+
+	switch o.ConnectionMode {
+	case ConnectionShared:
+		// Every downloader holds its connection while streaming, so pool must never refuse idle ones.
+		// HTTP/2 is disabled, otherwise all downloaders would end up multiplexed over one connection.
+		t.ForceAttemptHTTP2 = false
+		t.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+		t.MaxIdleConns = 0
+		t.MaxIdleConnsPerHost = math.MaxInt
+	case ConnectionHTTP2:
+		t.MaxConnsPerHost = 1
+		// Single connection must never end up HTTP/1.1, or one downloader would hold it for the whole stream
+		// and the rest would wait for it forever
+		t.DialTLSContext = dialHTTP2(dial, t.TLSClientConfig, t.TLSHandshakeTimeout)
+	}
+
+	return t
+}
+
+// dialHTTP2 dials TLS connection which fails unless server agrees on HTTP/2
+func dialHTTP2(dial dialFunc, config *tls.Config, handshakeTimeout time.Duration) dialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		c, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+
+		cfg := config.Clone()
+		if cfg == nil {
+			cfg = &tls.Config{}
+		}
+		if cfg.ServerName == "" {
+			cfg.ServerName, _, _ = net.SplitHostPort(addr)
+		}
+		cfg.NextProtos = []string{"h2"}
+
+		hsCtx, cancel := context.WithTimeout(ctx, handshakeTimeout)
+		defer cancel()
+
+		tc := tls.Client(c, cfg)
+		if err := tc.HandshakeContext(hsCtx); err != nil {
+			c.Close()
+			return nil, err
+		}
+
+		if proto := tc.ConnectionState().NegotiatedProtocol; proto != "h2" {
+			tc.Close()
+			return nil, fmt.Errorf("server %s does not support HTTP/2, required by h2 connection mode", addr)
+		}
+
+		return tc, nil
+	}
+}
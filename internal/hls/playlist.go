@@ -0,0 +1,209 @@
+package hls
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Segment is media segment of media playlist
+type Segment struct {
+	URL      *url.URL
+	Sequence int64
+	Duration time.Duration
+	// ProgramDateTime is wall clock time of the segment start, zero if playlist does not tell
+	ProgramDateTime time.Time
+}
+
+// MediaPlaylist is what we need from media playlist to play it, everything else is ignored
+type MediaPlaylist struct {
+	TargetDuration time.Duration
+	MediaSequence  int64
+	Segments       []Segment
+	// EndList is set for finished (VOD) playlists, which will not be updated anymore
+	EndList bool
+}
+
+// Variant is stream of master playlist
+type Variant struct {
+	URL *url.URL
+	// Bandwidth is peak bitrate in bits per second
+	Bandwidth int64
+}
+
+// Playlist is either master or media playlist, exactly one of the fields is set
+type Playlist struct {
+	Master []Variant
+	Media  *MediaPlaylist
+}
+
+// Parse reads playlist, resolving URIs against base
+func Parse(r io.Reader, base *url.URL) (*Playlist, error) {
+	s := bufio.NewScanner(r)
+	if !s.Scan() || strings.TrimSpace(s.Text()) != "#EXTM3U" {
+		if first := strings.TrimSpace(s.Text()); strings.HasPrefix(first, "<?xml") || strings.HasPrefix(first, "<MPD") {
+			return nil, fmt.Errorf("DASH manifests are not supported, only HLS playlists are")
+		}
+		return nil, fmt.Errorf("not an HLS playlist: missing #EXTM3U")
+	}
+
+	var variants []Variant
+	media := &MediaPlaylist{}
+	isMedia := false
+
+	var (
+		nextVariant  *Variant
+		nextDuration time.Duration
+		nextPDT      time.Time
+		lastPDTEnd   time.Time
+	)
+
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		tag, value, _ := strings.Cut(line, ":")
+
+		switch {
+		case line == "":
+		case tag == "#EXT-X-STREAM-INF":
+			bw, err := strconv.ParseInt(attribute(value, "BANDWIDTH"), 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("bad variant BANDWIDTH: %v", err)
+			}
+			nextVariant = &Variant{Bandwidth: bw}
+		case tag == "#EXT-X-TARGETDURATION":
+			isMedia = true
+			secs, err := strconv.Atoi(value)
+			if err != nil {
+				return nil, fmt.Errorf("bad EXT-X-TARGETDURATION: %v", err)
+			}
+			media.TargetDuration = time.Duration(secs) * time.Second
+		case tag == "#EXT-X-MEDIA-SEQUENCE":
+			seq, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("bad EXT-X-MEDIA-SEQUENCE: %v", err)
+			}
+			media.MediaSequence = seq
+		case tag == "#EXT-X-ENDLIST":
+			media.EndList = true
+		case tag == "#EXT-X-PROGRAM-DATE-TIME":
+			// Time which does not parse is ignored, so latency is estimated from live edge instead
+			nextPDT, _ = parseDateTime(value)
+		case tag == "#EXTINF":
+			isMedia = true
+			secs, _, _ := strings.Cut(value, ",")
+			d, err := strconv.ParseFloat(secs, 64)
+			if err != nil {
+				return nil, fmt.Errorf("bad EXTINF duration: %v", err)
+			}
+			nextDuration = time.Duration(d * float64(time.Second))
+		case tag == "#EXT-X-PART-INF" || tag == "#EXT-X-PART" || tag == "#EXT-X-PRELOAD-HINT":
+			// Playing such stream by full segments would report latency of regular HLS, not of LL-HLS
+			return nil, fmt.Errorf("low-latency HLS playlists (with %s) are not supported", tag)
+		case strings.HasPrefix(line, "#"):
+			// Tag we do not care about
+		default:
+			u, err := base.Parse(line)
+			if err != nil {
+				return nil, fmt.Errorf("bad URI %q: %v", line, err)
+			}
+
+			if nextVariant != nil {
+				nextVariant.URL = u
+				variants = append(variants, *nextVariant)
+				nextVariant = nil
+				continue
+			}
+
+			// Program date time applies to the following segments as well
+			if nextPDT.IsZero() && !lastPDTEnd.IsZero() {
+				nextPDT = lastPDTEnd
+			}
+
+			media.Segments = append(media.Segments, Segment{
+				URL:             u,
+				Sequence:        media.MediaSequence + int64(len(media.Segments)),
+				Duration:        nextDuration,
+				ProgramDateTime: nextPDT,
+			})
+
+			if !nextPDT.IsZero() {
+				lastPDTEnd = nextPDT.Add(nextDuration)
+			}
+			nextDuration, nextPDT = 0, time.Time{}
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+
+	if isMedia {
+		return &Playlist{Media: media}, nil
+	}
+
+	if len(variants) == 0 {
+		return nil, fmt.Errorf("playlist has neither variants nor segments")
+	}
+
+	return &Playlist{Master: variants}, nil
+}
+
+// PickVariant returns variant with highest bandwidth not exceeding given one, or the lowest one
+func PickVariant(variants []Variant, bandwidth int64) Variant {
+	best := variants[0]
+	for _, v := range variants[1:] {
+		fits, bestFits := v.Bandwidth <= bandwidth, best.Bandwidth <= bandwidth
+		switch {
+		case fits && (!bestFits || v.Bandwidth > best.Bandwidth):
+			best = v
+		case !fits && !bestFits && v.Bandwidth < best.Bandwidth:
+			best = v
+		}
+	}
+
+	return best
+}
+
+// attribute extracts value from attribute list like BANDWIDTH=1000,CODECS="a,b"
+func attribute(list, name string) string {
+	for len(list) > 0 {
+		var key string
+		key, list, _ = strings.Cut(list, "=")
+
+		var value string
+		if strings.HasPrefix(list, `"`) {
+			value, list, _ = strings.Cut(list[1:], `"`)
+			list = strings.TrimPrefix(list, ",")
+		} else {
+			value, list, _ = strings.Cut(list, ",")
+		}
+
+		if strings.TrimSpace(key) == name {
+			return value
+		}
+	}
+
+	return ""
+}
+
+// Packagers emit ISO 8601 variants besides RFC 3339, like +0000 offsets or no seconds fraction
+var dateTimeLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05.999999999Z0700",
+	"2006-01-02T15:04:05.999999999Z07",
+}
+
+func parseDateTime(s string) (time.Time, error) {
+	var err error
+	for _, layout := range dateTimeLayouts {
+		var t time.Time
+		if t, err = time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+
+	return time.Time{}, err
+}
@@ -0,0 +1,67 @@
+package player
+
+import (
+	"log/slog"
+	"math/rand/v2"
+	"time"
+)
+
+// Behavior describes how viewer interacts with the player. Rates are average numbers of events
+// per minute of playback, zero rate disables the event.
+type Behavior struct {
+	// Pause playback for random time, PauseDuration on average
+	PauseRate     float64
+	PauseDuration time.Duration
+	// Seek to random offset in the content, requires content length to be known
+	SeekRate float64
+	// Skip SkipDuration worth of content forward or backward
+	SkipRate     float64
+	SkipDuration time.Duration
+}
+
+// act randomly decides whether viewer does something instead of watching the next frame.
+// Returns true if frame should not be played.
+func (e *Emulator) act() bool {
+	bh := &e.behavior
+	perFrame := 1 / 60. / float64(e.fps)
+
+	switch {
+	case bh.PauseRate > 0 && rand.Float64() < bh.PauseRate*perFrame:
+		d := time.Duration(rand.ExpFloat64() * float64(bh.PauseDuration))
+		e.pausedUntil = time.Now().Add(d)
+		e.b.l.Info("Pause playback", slog.Duration("duration", d))
+		return true
+	case bh.SeekRate > 0 && rand.Float64() < bh.SeekRate*perFrame:
+		length := e.b.contentLength()
+		if length <= 0 {
+			return false
+		}
+
+		return e.seek(rand.Int64N(length))
+	case bh.SkipRate > 0 && rand.Float64() < bh.SkipRate*perFrame:
+		skip := int64(bh.SkipDuration.Seconds() * float64(e.b.br))
+		if rand.IntN(2) == 0 {
+			skip = -skip
+		}
+
+		offset := max(e.b.playbackOffset()+skip, 0)
+		if length := e.b.contentLength(); length > 0 {
+			offset = min(offset, length-1)
+		}
+
+		return e.seek(offset)
+	}
+
+	return false
+}
+
+func (e *Emulator) seek(offset int64) bool {
+	if !e.b.seek(offset, e.fps) {
+		// Download has failed, so remaining buffer is all we can play
+		return false
+	}
+
+	e.b.l.Info("Seek playback", slog.Int64("offset", offset))
+	e.buffering = true
+	return true
+}
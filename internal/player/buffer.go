@@ -2,7 +2,6 @@ package player
 
 import (
 	"context"
-	"io"
 	"log/slog"
 	"net/url"
 	"sync"
@@ -14,107 +13,143 @@ import (
 
 type Buffer struct {
 	d                *downloader.Downloader
+	s                *Scheduler
 	br               bitrate.Bitrate
+	frames           *frameSizer
 	minBuff, maxBuff int
 	topBufDelay      time.Duration
 	l                *slog.Logger
 
 	lock   sync.Locker
-	waitC  chan struct{}
 	nBytes int
+	// Offset in the content of the next byte to play
+	pos int64
+	// Incremented by seek, so resume scheduled before it is ignored
+	seeks int
 }
 
-func NewBuffer(url *url.URL, br bitrate.Bitrate, minBuf, maxBuf int, topBufDelay time.Duration, ctx context.Context, l *slog.Logger) *Buffer {
+func NewBuffer(url *url.URL, opts *downloader.Options, s *Scheduler, br bitrate.Bitrate, content *ContentModel, minBuf, maxBuf int, topBufDelay time.Duration, ctx context.Context, l *slog.Logger) *Buffer {
 	b := Buffer{
+		s:           s,
 		br:          br,
+		frames:      newFrameSizer(content, br),
 		minBuff:     int(br) * minBuf,
 		maxBuff:     int(br) * maxBuf,
 		topBufDelay: topBufDelay,
 		l:           l,
 		lock:        &sync.Mutex{},
-		waitC:       make(chan struct{}),
 	}
-	b.d = downloader.StartNewDownloader(url, b.handleNewBytes, ctx, l)
+	b.d = downloader.StartNewDownloader(url, opts, b.handleNewBytes, b.deficit, ctx, l)
 	l.Info("Starting filling buffer")
 	return &b
 }
 
-func (b *Buffer) GetNextFrame(fps int) error {
-	for {
-		c := b.getBytesOrChannel(fps)
-		if c == nil {
-			return nil
-		}
+// takeFrame consumes bytes of the next frame if there are enough of them.
+// While buffering it also requires minimal buffer to be filled before playing resumes.
+func (b *Buffer) takeFrame(fps int, buffering bool) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
 
-		b.l.Info("Cant play, wait while buffering")
-
-		select {
-		case <-c:
-			b.l.Info("Continue playing")
-		case <-b.d.WaitC():
-			_, err := b.d.GetState()
-			if err != nil {
-				b.l.Error("Cant continue playing because download failed: " + err.Error())
-				return err
-			}
-			b.l.Info("Cant continue playing because end of file")
-			return io.EOF
-		}
+	needBytes := b.frames.size(fps)
+	if b.nBytes < needBytes || buffering && b.nBytes < b.minBuff {
+		return false
 	}
+
+	b.frames.advance(fps)
+	b.nBytes -= needBytes
+	b.pos += int64(needBytes)
+	return true
 }
 
-func (b *Buffer) getBytesOrChannel(fps int) chan struct{} {
+// seek drops buffered data and makes download continue from the offset, with frames going on
+// from the one at the offset. Returns false if download has failed, then buffer is left as it is.
+func (b *Buffer) seek(offset int64, fps int) bool {
+	// Lock is held, so bytes from the offset are not counted before buffer is dropped
 	b.lock.Lock()
 	defer b.lock.Unlock()
 
-	needBytes := int(b.br) / fps
-	if b.nBytes >= needBytes {
-		b.nBytes -= needBytes
-		return nil
+	if !b.d.SeekTo(offset) {
+		return false
 	}
 
-	if b.waitC == nil {
-		b.waitC = make(chan struct{})
+	b.nBytes = 0
+	b.pos = offset
+	b.frames.seek(offset, fps)
+	b.seeks++
+	return true
+}
+
+func (b *Buffer) playbackOffset() int64 {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return b.pos
+}
+
+func (b *Buffer) contentLength() int64 {
+	return b.d.ContentLength()
+}
+
+func (b *Buffer) downloadFinished() (bool, error) {
+	select {
+	case <-b.d.WaitC():
+		_, err := b.d.GetState()
+		return true, err
+	default:
+		return false, nil
 	}
+}
 
-	return b.waitC
+// deficit tells how many bytes buffer lacks to be full
+func (b *Buffer) deficit() int64 {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return int64(max(b.maxBuff-b.nBytes, 0))
 }
 
 func (b *Buffer) handleNewBytes(bs []byte) (needMore bool) {
-	var waitC chan struct{}
 	cont := true
+	var seeks int
 
 	func() {
 		b.lock.Lock()
 		defer b.lock.Unlock()
 
 		b.nBytes += len(bs)
-		if b.waitC != nil && b.nBytes >= b.minBuff {
-			waitC = b.waitC
-			b.waitC = nil
-		}
 		if b.nBytes >= b.maxBuff {
 			cont = false
 		}
+		seeks = b.seeks
 	}()
 
-	if waitC != nil {
-		close(waitC)
-	}
-
 	if !cont {
 		b.l.Debug("Buffer is full, ask to pause download")
 
-		go func() {
-			time.Sleep(b.topBufDelay)
-
-			if b.d.Resume() {
-				b.l.Debug("Resuming download")
-			} else {
-				b.l.Warn("Wanted to resume download buy it is already active")
-			}
-		}()
+		b.s.AfterFunc(b.topBufDelay, func() {
+			b.resume(seeks)
+		})
 	}
 
 	return cont
 }
+
+// resume resumes download paused when buffer was full, unless there was seek since then
+func (b *Buffer) resume(seeks int) {
+	b.lock.Lock()
+	stale := b.seeks != seeks
+	b.lock.Unlock()
+
+	if stale {
+		// Seek has resumed download already, and it may be paused again with its own resume scheduled
+		b.l.Debug("Ignore resume scheduled before seek")
+		return
+	}
+
+	if b.d.Resume() {
+		b.l.Debug("Resuming download")
+	} else if running, _ := b.d.GetState(); running {
+		// Seek might have resumed it already, otherwise something is off
+		b.l.Debug("Wanted to resume download buy it is already active")
+	}
+}
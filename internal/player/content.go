@@ -0,0 +1,125 @@
+package player
+
+import (
+	"math"
+	"math/rand/v2"
+
+	"dst/internal/bitrate"
+)
+
+// ContentModel describes how size of frames varies over the content. Zero value is constant bitrate.
+// Average bitrate is kept equal to the target one in any case.
+type ContentModel struct {
+	// GOPSize is number of frames in group of pictures, which starts with I-frame, 0 or 1 means no GOP structure
+	GOPSize int
+	// IFrameRatio is how many times I-frame is bigger than other frames of GOP
+	IFrameRatio float64
+	// Complexity is volatility of scene complexity, which does random walk every second and scales frame sizes.
+	// 0 disables it, 0.3 means about 30% bitrate deviations second to second.
+	Complexity float64
+	// Trace, if set, overrides target bitrate for every second of the content, looping if content is longer
+	Trace []bitrate.Bitrate
+}
+
+// How fast scene complexity returns to average
+const complexityReversion = 0.9
+
+// frameSizer walks through the content frame by frame, it is not safe for concurrent use
+type frameSizer struct {
+	m  *ContentModel
+	br bitrate.Bitrate
+
+	frame int64
+	// Logarithm of current scene complexity
+	complexity float64
+
+	// Frames after which sizes repeat, and their total size, for seeking. Counted on first seek.
+	cycleFrames int64
+	cycleBytes  int64
+}
+
+func newFrameSizer(m *ContentModel, br bitrate.Bitrate) *frameSizer {
+	if m == nil {
+		m = &ContentModel{}
+	}
+
+	return &frameSizer{m: m, br: br}
+}
+
+// size returns size of the current frame in bytes
+func (f *frameSizer) size(fps int) int {
+	size := f.plainSize(f.frame, fps)
+
+	if sigma := f.m.Complexity; sigma > 0 {
+		// Divide by mean of log-normal distribution with stationary variance of the walk
+		variance := sigma * sigma / (1 - complexityReversion*complexityReversion)
+		size *= math.Exp(f.complexity - variance/2)
+	}
+
+	return max(int(size), 1)
+}
+
+// plainSize is size of given frame without scene complexity
+func (f *frameSizer) plainSize(frame int64, fps int) float64 {
+	br := f.br
+	if len(f.m.Trace) > 0 {
+		br = f.m.Trace[(frame/int64(fps))%int64(len(f.m.Trace))]
+	}
+
+	size := float64(br) / float64(fps)
+
+	if gop := f.m.GOPSize; gop > 1 {
+		p := size * float64(gop) / (f.m.IFrameRatio + float64(gop-1))
+		if frame%int64(gop) == 0 {
+			size = p * f.m.IFrameRatio
+		} else {
+			size = p
+		}
+	}
+
+	return size
+}
+
+// seek moves to the frame content offset falls in, so bitrate trace and GOP go on from there.
+// Frames are counted without scene complexity, which is random anyway.
+func (f *frameSizer) seek(offset int64, fps int) {
+	if f.cycleFrames == 0 {
+		// Frame sizes repeat once both trace and GOP start over
+		f.cycleFrames = int64(fps) * int64(max(len(f.m.Trace), 1))
+		if gop := int64(f.m.GOPSize); gop > 1 {
+			f.cycleFrames = f.cycleFrames / gcd(f.cycleFrames, gop) * gop
+		}
+		for i := range f.cycleFrames {
+			f.cycleBytes += int64(max(int(f.plainSize(i, fps)), 1))
+		}
+	}
+
+	f.frame = offset / f.cycleBytes * f.cycleFrames
+	offset %= f.cycleBytes
+	for {
+		size := int64(max(int(f.plainSize(f.frame, fps)), 1))
+		if offset < size {
+			return
+		}
+
+		offset -= size
+		f.frame++
+	}
+}
+
+func gcd(a, b int64) int64 {
+	for b != 0 {
+		a, b = b, a%b
+	}
+
+	return a
+}
+
+// advance moves on to the next frame
+func (f *frameSizer) advance(fps int) {
+	f.frame++
+
+	if f.m.Complexity > 0 && f.frame%int64(fps) == 0 {
+		f.complexity = complexityReversion*f.complexity + rand.NormFloat64()*f.m.Complexity
+	}
+}
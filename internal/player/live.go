@@ -0,0 +1,438 @@
+package player
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"dst/internal/bitrate"
+	"dst/internal/downloader"
+	"dst/internal/hls"
+)
+
+// LiveOptions configure playback of live streams
+type LiveOptions struct {
+	// TargetLatency is how far behind live edge viewer joins and then tries to stay.
+	// Zero means 3 target durations, as HLS spec recommends.
+	TargetLatency time.Duration
+	// ReportInterval is how often viewer reports its live latency
+	ReportInterval time.Duration
+}
+
+// Playback speeds up to catch up with live edge when latency exceeds target by more than this
+const (
+	catchUpRate      = 1.1
+	catchUpTolerance = time.Second
+)
+
+type liveSegment struct {
+	// Wall clock time of the segment start: program date time, or estimated by live edge
+	start    time.Time
+	duration time.Duration
+	played   time.Duration
+}
+
+// LiveEmulator plays live HLS stream: joins it at live edge and reports how far behind it is playing.
+// Buffer is measured in media time rather than bytes, bitrate is only used to pick variant of master playlist.
+type LiveEmulator struct {
+	url            *url.URL
+	opts           *downloader.Options
+	client         *http.Client
+	ctx            context.Context
+	s              *Scheduler
+	br             bitrate.Bitrate
+	minBuf, maxBuf time.Duration
+	topBufDelay    time.Duration
+	live           LiveOptions
+	l              *slog.Logger
+
+	lock     sync.Mutex
+	segments []liveSegment
+	buffered time.Duration
+	// Target latency resolved against target duration of the playlist
+	targetLatency time.Duration
+	fetchDone     bool
+	fetchErr      error
+	behindWindow  int
+
+	// Only accessed from scheduler goroutine
+	buffering  bool
+	rate       float64
+	lastTick   time.Time
+	playhead   time.Time
+	nextReport time.Time
+	stalls     int
+	onDone     func(error)
+}
+
+func NewLiveEmulator(url *url.URL, opts *downloader.Options, s *Scheduler, br bitrate.Bitrate, minBuf, maxBuf int, topBufDelay time.Duration, live LiveOptions, ctx context.Context, l *slog.Logger) *LiveEmulator {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	return &LiveEmulator{
+		url:         url,
+		opts:        opts,
+		client:      opts.NewClient(),
+		ctx:         ctx,
+		s:           s,
+		br:          br,
+		minBuf:      time.Duration(minBuf) * time.Second,
+		maxBuf:      time.Duration(maxBuf) * time.Second,
+		topBufDelay: topBufDelay,
+		live:        live,
+		l:           l,
+		rate:        1,
+	}
+}
+
+func (e *LiveEmulator) Start(onDone func(error)) {
+	e.buffering = true
+	e.onDone = onDone
+	e.nextReport = time.Now().Add(e.live.ReportInterval)
+
+	e.l.Info("Starting filling buffer")
+	go e.fetch()
+	e.s.add(e)
+}
+
+func (e *LiveEmulator) Run() error {
+	return runAndWait(e)
+}
+
+func (e *LiveEmulator) tick() {
+	// Play as much media as time has passed since the last tick, so late ticks do not slow playback down
+	now := time.Now()
+	step := time.Duration(float64(now.Sub(e.lastTick)) * e.rate)
+	e.lastTick = now
+
+	if e.buffering {
+		// Resuming playback starts with a single frame worth of media
+		step = e.s.tick
+	}
+
+	if e.takeMedia(step) {
+		if e.buffering {
+			e.buffering = false
+			e.l.Info("Continue playing")
+		}
+
+		e.adjustRate()
+		e.report()
+		return
+	}
+
+	if !e.buffering {
+		e.buffering = true
+		e.stalls++
+		e.l.Info("Cant play, wait while buffering")
+	}
+
+	e.report()
+
+	e.lock.Lock()
+	done, err := e.fetchDone, e.fetchErr
+	e.lock.Unlock()
+	if !done {
+		return
+	}
+
+	if err != nil {
+		e.l.Error("Cant continue playing because download failed: " + err.Error())
+	} else {
+		e.l.Info("Cant continue playing because stream ended")
+	}
+
+	e.s.remove(e)
+	e.onDone(err)
+}
+
+// takeMedia plays given duration from the buffer if there is enough of it, moving playhead
+func (e *LiveEmulator) takeMedia(d time.Duration) bool {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if e.buffered < d || e.buffering && e.buffered < e.minBuf {
+		return false
+	}
+
+	e.buffered -= d
+	for d > 0 {
+		seg := &e.segments[0]
+		take := min(d, seg.duration-seg.played)
+		seg.played += take
+		d -= take
+		e.playhead = seg.start.Add(seg.played)
+
+		if seg.played >= seg.duration {
+			e.segments = e.segments[1:]
+		}
+	}
+
+	return true
+}
+
+func (e *LiveEmulator) latency() time.Duration {
+	if e.playhead.IsZero() {
+		return 0
+	}
+
+	return time.Since(e.playhead)
+}
+
+// adjustRate speeds playback up while viewer is too far behind live edge
+func (e *LiveEmulator) adjustRate() {
+	e.lock.Lock()
+	target := e.targetLatency
+	e.lock.Unlock()
+
+	latency := e.latency()
+	switch {
+	case e.rate == 1 && latency > target+catchUpTolerance:
+		e.rate = catchUpRate
+		e.l.Debug("Speed up playback to catch up with live edge", slog.Duration("latency", latency))
+	case e.rate != 1 && latency <= target:
+		e.rate = 1
+		e.l.Debug("Caught up with live edge", slog.Duration("latency", latency))
+	}
+}
+
+func (e *LiveEmulator) report() {
+	if e.live.ReportInterval <= 0 || time.Now().Before(e.nextReport) {
+		return
+	}
+	e.nextReport = time.Now().Add(e.live.ReportInterval)
+
+	e.lock.Lock()
+	buffered, behind := e.buffered, e.behindWindow
+	e.lock.Unlock()
+
+	e.l.Info("Live latency", slog.Duration("latency", e.latency().Round(time.Millisecond)),
+		slog.Duration("buffer", buffered.Round(time.Millisecond)), slog.Float64("rate", e.rate),
+		slog.Int("stalls", e.stalls), slog.Int("behind_window", behind))
+}
+
+// fetch keeps downloading segments in the background, until stream ends or download fails
+func (e *LiveEmulator) fetch() {
+	err := e.fetchSegments()
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	e.fetchDone = true
+	if err != io.EOF {
+		e.fetchErr = err
+	}
+}
+
+func (e *LiveEmulator) fetchSegments() error {
+	mediaURL, pl, err := e.loadMedia()
+	if err != nil {
+		return err
+	}
+	loadedAt := time.Now()
+
+	e.lock.Lock()
+	e.targetLatency = e.live.TargetLatency
+	if e.targetLatency == 0 {
+		e.targetLatency = 3 * pl.TargetDuration
+	}
+	target := e.targetLatency
+	e.lock.Unlock()
+
+	next := liveEdgeSequence(pl, target)
+	e.l.Info("Join live stream", slog.Int64("sequence", next), slog.Duration("target_latency", target))
+
+	reload := func() error {
+		loaded, err := e.loadPlaylist(mediaURL)
+		if err != nil {
+			return err
+		}
+		if loaded.Media == nil {
+			return fmt.Errorf("media playlist turned into master playlist")
+		}
+
+		pl, loadedAt = loaded.Media, time.Now()
+		return nil
+	}
+
+	for {
+		if err := e.waitBufferRoom(); err != nil {
+			return err
+		}
+
+		// Window might have moved while we were waiting
+		if !pl.EndList && time.Since(loadedAt) >= pl.TargetDuration {
+			if err := reload(); err != nil {
+				return err
+			}
+		}
+
+		if next < pl.MediaSequence {
+			e.l.Warn("Fell behind live window, rejoin at live edge",
+				slog.Int64("sequence", next), slog.Int64("window_start", pl.MediaSequence))
+			e.rejoin()
+			next = liveEdgeSequence(pl, target)
+			continue
+		}
+
+		if idx := next - pl.MediaSequence; idx < int64(len(pl.Segments)) {
+			seg := pl.Segments[idx]
+			if err := e.download(seg.URL); err != nil {
+				return err
+			}
+
+			e.addSegment(seg, pl, loadedAt)
+			next++
+			continue
+		}
+
+		if pl.EndList {
+			return io.EOF
+		}
+
+		// No new segments yet, HLS spec says to wait at least half target duration before reloading
+		if err := e.sleep(time.Until(loadedAt.Add(pl.TargetDuration / 2))); err != nil {
+			return err
+		}
+
+		if err := reload(); err != nil {
+			return err
+		}
+	}
+}
+
+// loadMedia loads playlist from URL, and if it is master one, picks variant fitting bitrate
+func (e *LiveEmulator) loadMedia() (*url.URL, *hls.MediaPlaylist, error) {
+	pl, err := e.loadPlaylist(e.url)
+	if err != nil {
+		return nil, nil, err
+	}
+	if pl.Media != nil {
+		return e.url, pl.Media, nil
+	}
+
+	v := hls.PickVariant(pl.Master, int64(e.br)*8)
+	e.l.Info("Picked variant", slog.String("url", v.URL.String()), slog.Int64("bandwidth", v.Bandwidth))
+
+	media, err := e.loadPlaylist(v.URL)
+	if err != nil {
+		return nil, nil, err
+	}
+	if media.Media == nil {
+		return nil, nil, fmt.Errorf("variant playlist is master playlist")
+	}
+
+	return v.URL, media.Media, nil
+}
+
+func (e *LiveEmulator) loadPlaylist(u *url.URL) (*hls.Playlist, error) {
+	resp, err := e.client.Do(e.opts.NewRequest(u, e.ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("bad status code of playlist: %d", resp.StatusCode)
+	}
+
+	return hls.Parse(resp.Body, u)
+}
+
+func (e *LiveEmulator) download(u *url.URL) error {
+	resp, err := e.client.Do(e.opts.NewRequest(u, e.ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("bad status code of segment: %d", resp.StatusCode)
+	}
+
+	n, err := io.Copy(io.Discard, resp.Body)
+	if err != nil {
+		return fmt.Errorf("error reading segment: %v", err)
+	}
+
+	e.l.Debug("Downloaded segment", slog.String("url", u.String()), slog.Int64("bytes", n))
+	return nil
+}
+
+// liveEdgeSequence picks segment to start playing from to be target latency behind live edge
+func liveEdgeSequence(pl *hls.MediaPlaylist, target time.Duration) int64 {
+	var behind time.Duration
+	i := len(pl.Segments)
+	for i > 0 && behind < target {
+		i--
+		behind += pl.Segments[i].Duration
+	}
+
+	return pl.MediaSequence + int64(i)
+}
+
+func (e *LiveEmulator) addSegment(seg hls.Segment, pl *hls.MediaPlaylist, loadedAt time.Time) {
+	start := seg.ProgramDateTime
+	if start.IsZero() {
+		// Assume last segment of the playlist ended just when we loaded it
+		start = loadedAt
+		for _, s := range pl.Segments[seg.Sequence-pl.MediaSequence:] {
+			start = start.Add(-s.Duration)
+		}
+	}
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	e.segments = append(e.segments, liveSegment{start: start, duration: seg.Duration})
+	e.buffered += seg.Duration
+}
+
+// rejoin drops buffered segments, which are now out of live window anyway
+func (e *LiveEmulator) rejoin() {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	e.segments = nil
+	e.buffered = 0
+	e.behindWindow++
+}
+
+func (e *LiveEmulator) waitBufferRoom() error {
+	for {
+		e.lock.Lock()
+		full := e.buffered >= e.maxBuf
+		e.lock.Unlock()
+
+		if !full {
+			return nil
+		}
+
+		// Media is consumed once per scheduler tick, so there is no point to check more often
+		if err := e.sleep(max(e.topBufDelay, e.s.tick)); err != nil {
+			return err
+		}
+	}
+}
+
+func (e *LiveEmulator) sleep(d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-e.ctx.Done():
+		return e.ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
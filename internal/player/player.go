@@ -1,28 +1,120 @@
 package player
 
 import (
-	"io"
 	"time"
 )
 
+// Viewer is emulated viewer, which is driven by Scheduler
+type Viewer interface {
+	// Start begins playback in the background. Once playback is over, onDone is called from scheduler goroutine
+	// with nil error if whole content was played, so it MUST be fast.
+	Start(onDone func(error))
+	// Run begins playback and waits until it is over
+	Run() error
+}
+
+func runAndWait(v Viewer) error {
+	errC := make(chan error, 1)
+	v.Start(func(err error) {
+		errC <- err
+	})
+
+	return <-errC
+}
+
+// Emulator plays video from Buffer frame by frame. Frames are due by playback clock rather than by scheduler
+// ticks, so late or missed ticks do not make viewer consume less than bitrate times playback time.
 type Emulator struct {
-	b *Buffer
+	b        *Buffer
+	s        *Scheduler
+	fps      int
+	rate     float64
+	behavior Behavior
+
+	// Only accessed from scheduler goroutine
+	buffering   bool
+	pausedUntil time.Time
+	// Playback clock, restarted whenever playback resumes after buffering, pause or seek
+	clockStart time.Time
+	played     int64
+	onDone     func(error)
+}
+
+func NewEmulator(b *Buffer, s *Scheduler, fps int, rate float64, behavior Behavior) *Emulator {
+	return &Emulator{b: b, s: s, fps: fps, rate: rate, behavior: behavior}
 }
 
-func NewEmulator(b *Buffer) *Emulator {
-	return &Emulator{b: b}
+func (e *Emulator) Start(onDone func(error)) {
+	e.buffering = true
+	e.onDone = onDone
+	e.s.add(e)
 }
 
 func (e *Emulator) Run() error {
-	for {
-		err := e.b.GetNextFrame(24)
-		if err == io.EOF {
-			return nil
+	return runAndWait(e)
+}
+
+func (e *Emulator) tick() {
+	if !e.pausedUntil.IsZero() {
+		if time.Now().Before(e.pausedUntil) {
+			return
+		}
+
+		e.pausedUntil = time.Time{}
+		e.restartClock()
+		e.b.l.Info("Continue playing after pause")
+	}
+
+	if e.buffering {
+		if !e.b.takeFrame(e.fps, true) {
+			e.checkFinished()
+			return
 		}
-		if err != nil {
-			return err
+
+		e.buffering = false
+		e.restartClock()
+		e.played++
+		e.b.l.Info("Continue playing")
+	}
+
+	for e.played < e.dueFrames() {
+		if e.act() {
+			return
 		}
 
-		time.Sleep(time.Second / 24)
+		if !e.b.takeFrame(e.fps, false) {
+			e.buffering = true
+			e.b.l.Info("Cant play, wait while buffering")
+			e.checkFinished()
+			return
+		}
+		e.played++
+	}
+}
+
+func (e *Emulator) restartClock() {
+	e.clockStart = time.Now()
+	e.played = 0
+}
+
+// dueFrames returns how many frames should have been played since clock start, first one is due right away
+func (e *Emulator) dueFrames() int64 {
+	return int64(time.Since(e.clockStart).Seconds()*float64(e.fps)*e.rate) + 1
+}
+
+// checkFinished stops playback if buffer is exhausted and nothing more is coming
+func (e *Emulator) checkFinished() {
+	finished, err := e.b.downloadFinished()
+	if !finished {
+		return
 	}
+
+	if err != nil {
+		e.b.l.Error("Cant continue playing because download failed: " + err.Error())
+	} else {
+		e.b.l.Info("Cant continue playing because end of file")
+	}
+
+	e.s.remove(e)
+	e.onDone(err)
 }
@@ -0,0 +1,128 @@
+package player
+
+import (
+	"sync"
+	"time"
+)
+
+// ticker is viewer which plays one frame per tick
+type ticker interface {
+	tick()
+}
+
+// Scheduler drives playback of many viewers from single goroutine. Frame ticks and delayed callbacks
+// (like resuming paused download) are processed on fixed ticks, so idle viewers cost no goroutines or timers.
+// Safe for concurrent use from different goroutines.
+type Scheduler struct {
+	tick time.Duration
+
+	lock    sync.Mutex
+	viewers map[ticker]struct{}
+	// Delayed callbacks bucketed by the number of tick at which they are due
+	timers  map[uint64][]func()
+	nTick   uint64
+	running bool
+	stopC   chan struct{}
+}
+
+func NewScheduler(tick time.Duration) *Scheduler {
+	return &Scheduler{
+		tick:    tick,
+		viewers: make(map[ticker]struct{}),
+		timers:  make(map[uint64][]func()),
+		stopC:   make(chan struct{}),
+	}
+}
+
+// Start begins ticking in the background, until Stop is called
+func (s *Scheduler) Start() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.running {
+		return
+	}
+
+	s.running = true
+	go s.run()
+}
+
+func (s *Scheduler) Stop() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if !s.running {
+		return
+	}
+
+	s.running = false
+	close(s.stopC)
+}
+
+// AfterFunc calls f from the scheduler goroutine after at least d passes. f MUST be fast.
+func (s *Scheduler) AfterFunc(d time.Duration, f func()) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	ticks := uint64((d + s.tick - 1) / s.tick)
+	if ticks == 0 {
+		ticks = 1
+	}
+
+	at := s.nTick + ticks
+	s.timers[at] = append(s.timers[at], f)
+}
+
+func (s *Scheduler) add(v ticker) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.viewers[v] = struct{}{}
+}
+
+func (s *Scheduler) remove(v ticker) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	delete(s.viewers, v)
+}
+
+func (s *Scheduler) run() {
+	t := time.NewTicker(s.tick)
+	defer t.Stop()
+
+	var viewers []ticker
+
+	for {
+		select {
+		case <-s.stopC:
+			return
+		case <-t.C:
+		}
+
+		var due []func()
+		viewers = viewers[:0]
+
+		func() {
+			s.lock.Lock()
+			defer s.lock.Unlock()
+
+			s.nTick++
+			due = s.timers[s.nTick]
+			delete(s.timers, s.nTick)
+
+			for v := range s.viewers {
+				viewers = append(viewers, v)
+			}
+		}()
+
+		// Call outside of the lock, so callbacks may schedule more
+		for _, f := range due {
+			f()
+		}
+
+		for _, v := range viewers {
+			v.tick()
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"dst/internal/bitrate"
+	"dst/internal/conntrack"
+	"dst/internal/server"
+)
+
+// Options describe conditions proxy emulates on every client connection
+type Options struct {
+	// Bitrate limits every response, 0 means unlimited
+	Bitrate bitrate.Bitrate
+	// Latency is added before response headers are sent, Jitter is maximal random deviation from it
+	Latency time.Duration
+	Jitter  time.Duration
+	// FaultRate is probability of responding with FaultStatus instead of forwarding request upstream
+	FaultRate   float64
+	FaultStatus int
+	// AbortRate is probability of cutting connection at random point of response body
+	AbortRate float64
+}
+
+// Hop-by-hop headers, which must not be forwarded
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+type proxy struct {
+	upstream  *url.URL
+	opts      Options
+	transport *http.Transport
+	conns     conntrack.Tracker[struct{}]
+}
+
+func RunProxy(port int, upstream *url.URL, opts Options) error {
+	slog.Info(fmt.Sprintf("Listen for connection at :%d, forward to %s", port, upstream))
+
+	p := &proxy{
+		upstream: upstream,
+		opts:     opts,
+		transport: &http.Transport{
+			Proxy:                 http.ProxyFromEnvironment,
+			ForceAttemptHTTP2:     true,
+			MaxIdleConns:          100,
+			MaxIdleConnsPerHost:   100,
+			IdleConnTimeout:       90 * time.Second,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ExpectContinueTimeout: 1 * time.Second,
+			// Pass content to the client as is
+			DisableCompression: true,
+		},
+	}
+
+	srv := &http.Server{
+		Addr:        fmt.Sprintf(":%d", port),
+		Handler:     p,
+		ConnContext: p.conns.ConnContext,
+		ConnState:   p.conns.ConnState,
+	}
+
+	err := srv.ListenAndServe()
+	if err != nil {
+		slog.Error("Proxy stopped because of error: " + err.Error())
+		return err
+	}
+
+	return nil
+}
+
+func (p *proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	st := p.conns.FromContext(r.Context())
+	st.Requests.Add(1)
+
+	l := slog.Default().With(slog.String("remote_addr", r.RemoteAddr), slog.String("path", r.URL.Path))
+	l.Debug("Start forwarding a new request")
+
+	if p.opts.FaultRate > 0 && rand.Float64() < p.opts.FaultRate {
+		l.Debug("Inject fault", slog.Int("status", p.opts.FaultStatus))
+		w.WriteHeader(p.opts.FaultStatus)
+		return
+	}
+
+	resp, err := p.transport.RoundTrip(p.upstreamRequest(r))
+	if err != nil {
+		l.Error("Upstream request failed: " + err.Error())
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	if delay := p.delay(); delay > 0 {
+		time.Sleep(delay)
+	}
+
+	for _, h := range hopHeaders {
+		resp.Header.Del(h)
+	}
+	for k, vs := range resp.Header {
+		w.Header()[k] = vs
+	}
+	w.WriteHeader(resp.StatusCode)
+
+	var body http.ResponseWriter = w
+	if p.opts.AbortRate > 0 && rand.Float64() < p.opts.AbortRate {
+		body = server.NewAbortWriter(w, resp.ContentLength)
+	}
+	out := &countingWriter{w: body, st: st}
+
+	var n int64
+	if p.opts.Bitrate == 0 {
+		n, err = io.Copy(out, resp.Body)
+	} else {
+		n, err = server.CopyPaced(out, resp.Body, p.opts.Bitrate, nil)
+	}
+
+	if err == server.ErrAbort {
+		l.Debug("Abort response on purpose", slog.Int64("bytes_written", n))
+		// Makes server cut connection without logging
+		panic(http.ErrAbortHandler)
+	}
+	if err != nil {
+		l.Error("Error forwarding response: "+err.Error(), slog.Int64("bytes_written", n))
+	} else {
+		l.Debug("Finished forwarding the request", slog.Int64("bytes_written", n))
+	}
+}
+
+func (p *proxy) upstreamRequest(r *http.Request) *http.Request {
+	out := r.Clone(r.Context())
+	out.RequestURI = ""
+	out.Host = ""
+	out.URL.Scheme = p.upstream.Scheme
+	out.URL.Host = p.upstream.Host
+	out.URL.Path = strings.TrimSuffix(p.upstream.Path, "/") + r.URL.Path
+	out.URL.RawPath = ""
+	if p.upstream.RawQuery != "" && r.URL.RawQuery != "" {
+		out.URL.RawQuery = p.upstream.RawQuery + "&" + r.URL.RawQuery
+	} else if p.upstream.RawQuery != "" {
+		out.URL.RawQuery = p.upstream.RawQuery
+	}
+
+	for _, h := range hopHeaders {
+		out.Header.Del(h)
+	}
+	if ip, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		out.Header.Add("X-Forwarded-For", ip)
+	}
+
+	return out
+}
+
+func (p *proxy) delay() time.Duration {
+	if p.opts.Jitter == 0 {
+		return p.opts.Latency
+	}
+
+	return p.opts.Latency - p.opts.Jitter + rand.N(2*p.opts.Jitter+1)
+}
+
+// countingWriter adds written bytes to connection stats
+type countingWriter struct {
+	w  http.ResponseWriter
+	st *conntrack.Conn[struct{}]
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.st.AddWritten(int64(n))
+
+	return n, err
+}
+
+func (c *countingWriter) Flush() {
+	if f, ok := c.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
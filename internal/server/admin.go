@@ -0,0 +1,82 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+)
+
+// serveAdmin handles admin API, path is relative to admin prefix:
+//
+//	GET  /settings  current settings as JSON
+//	PUT  /settings  change settings given as JSON object, omitted fields are kept
+//	POST /drain     end responses in flight and close connections once they are done with them
+//	POST /kill      close all connections right away
+func (h *handler) serveAdmin(w http.ResponseWriter, r *http.Request, path string) {
+	if h.opts.AdminToken != "" &&
+		subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+h.opts.AdminToken)) != 1 {
+		http.Error(w, "bad admin token", http.StatusUnauthorized)
+		return
+	}
+
+	// Admin connection itself is left alone
+	self := h.m.connStats(r.Context())
+
+	switch {
+	case path == "/settings" && r.Method == http.MethodGet:
+		writeJSON(w, h.settings.Load())
+	case path == "/settings" && (r.Method == http.MethodPut || r.Method == http.MethodPost):
+		settings, err := h.updateSettings(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		writeJSON(w, settings)
+	case path == "/drain" && r.Method == http.MethodPost:
+		h.drains.Add(1)
+		n := h.m.closeConns(true, self)
+		slog.Info("Drain connections", slog.Int("connections", n))
+		writeJSON(w, map[string]int{"connections": n})
+	case path == "/kill" && r.Method == http.MethodPost:
+		n := h.m.closeConns(false, self)
+		slog.Info("Kill connections", slog.Int("connections", n))
+		writeJSON(w, map[string]int{"connections": n})
+	default:
+		http.Error(w, "unknown admin request", http.StatusNotFound)
+	}
+}
+
+func (h *handler) updateSettings(r *http.Request) (*Settings, error) {
+	h.adminLock.Lock()
+	defer h.adminLock.Unlock()
+
+	settings := *h.settings.Load()
+	if err := json.NewDecoder(r.Body).Decode(&settings); err != nil {
+		return nil, fmt.Errorf("bad settings: %v", err)
+	}
+
+	if err := settings.Validate(); err != nil {
+		return nil, err
+	}
+
+	h.egress.setRate(settings.EgressCap)
+	h.settings.Store(&settings)
+	h.m.slots.setLimit(settings.MaxConns)
+
+	slog.Info("Settings changed", slog.String("bitrate", settings.Bitrate.String()),
+		slog.String("egress_cap", settings.EgressCap.String()), slog.Int("max_conns", settings.MaxConns),
+		slog.Float64("fault_rate", settings.FaultRate), slog.Int("fault_status", settings.FaultStatus),
+		slog.Float64("abort_rate", settings.AbortRate))
+
+	return &settings, nil
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Error("Failed to write admin response: " + err.Error())
+	}
+}
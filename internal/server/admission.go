@@ -0,0 +1,131 @@
+package server
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// admission counts connections being served against connection limit, and lines up requests waiting for
+// a slot. Connection holds its slot only while it has requests in flight, idle keep-alive one gives it back.
+// Safe for concurrent use.
+type admission struct {
+	lock sync.Mutex
+	// Zero limit means no limit
+	limit int
+	taken int
+	// Requests waiting for a slot, in arrival order
+	queue []*admitWaiter
+}
+
+type admitWaiter struct {
+	st *connStats
+	// Closed once connection of the request is admitted
+	admittedC chan struct{}
+}
+
+func (a *admission) setLimit(limit int) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.limit = limit
+	// Raised limit lets queued requests in
+	a.admitQueued()
+}
+
+// take admits connection if it already is, or if there is free slot and nobody is waiting for it
+func (a *admission) take(st *connStats) bool {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	return a.takeLocked(st)
+}
+
+func (a *admission) takeLocked(st *connStats) bool {
+	if st.Ext.admitted {
+		// Concurrent request over the same HTTP/2 connection has admitted it already
+		return true
+	}
+
+	if len(a.queue) > 0 || !a.free() {
+		return false
+	}
+
+	a.taken++
+	st.Ext.admitted = true
+	return true
+}
+
+// wait admits connection like take, but if it can not be admitted right away,
+// request waits in line for a slot until timeout or until ctx is done
+func (a *admission) wait(ctx context.Context, st *connStats, timeout time.Duration) bool {
+	a.lock.Lock()
+	if a.takeLocked(st) {
+		a.lock.Unlock()
+		return true
+	}
+
+	w := &admitWaiter{st: st, admittedC: make(chan struct{})}
+	a.queue = append(a.queue, w)
+	a.lock.Unlock()
+
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+
+	select {
+	case <-w.admittedC:
+		return true
+	case <-ctx.Done():
+	case <-t.C:
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	for i, q := range a.queue {
+		if q == w {
+			a.queue = append(a.queue[:i], a.queue[i+1:]...)
+			return false
+		}
+	}
+
+	// Admitted just before giving up
+	return true
+}
+
+// leave gives back slot of connection, if it holds one
+func (a *admission) leave(st *connStats) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if !st.Ext.admitted {
+		return
+	}
+
+	st.Ext.admitted = false
+	a.taken--
+	a.admitQueued()
+}
+
+func (a *admission) free() bool {
+	return a.limit == 0 || a.taken < a.limit
+}
+
+// admitQueued lets in waiting requests from the head of the line while there are free slots
+func (a *admission) admitQueued() {
+	for len(a.queue) > 0 {
+		w := a.queue[0]
+		if !w.st.Ext.admitted {
+			if !a.free() {
+				return
+			}
+
+			a.taken++
+			w.st.Ext.admitted = true
+		}
+
+		a.queue[0] = nil
+		a.queue = a.queue[1:]
+		close(w.admittedC)
+	}
+}
@@ -0,0 +1,305 @@
+package server
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log/slog"
+	mrand "math/rand/v2"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// ContentMode is what bytes server responds with
+type ContentMode string
+
+const (
+	// ContentCrypto is output of crypto/rand, incompressible but slow
+	ContentCrypto ContentMode = "crypto"
+	// ContentChaCha8 is output of ChaCha8 PRNG, incompressible and several times faster than crypto/rand
+	ContentChaCha8 ContentMode = "chacha8"
+	// ContentXorshift is output of xorshift64* PRNG, the fastest incompressible content
+	ContentXorshift ContentMode = "xorshift"
+	// ContentZero is all zero bytes
+	ContentZero ContentMode = "zero"
+	// ContentText is random sequence of English words, which compresses like real text
+	ContentText ContentMode = "text"
+)
+
+// Random content of compressible modes is made of blocks this big, with random head and zero tail
+const ratioBlock = 4 << 10
+
+// NewContentReader returns reader of content server responds with, zero mode means crypto.
+// Random content is made compressible about compressRatio times, if it is above 1.
+// If randomBytes is not 0, block of that size is generated once and then cycled.
+func NewContentReader(mode ContentMode, compressRatio float64, randomBytes int) (io.Reader, error) {
+	var r io.Reader
+	switch mode {
+	case ContentCrypto, "":
+		r = bufio.NewReaderSize(rand.Reader, 16<<10)
+	case ContentChaCha8:
+		var seed [32]byte
+		if _, err := io.ReadFull(rand.Reader, seed[:]); err != nil {
+			return nil, err
+		}
+		r = &chacha8Reader{rnd: mrand.NewChaCha8(seed)}
+	case ContentXorshift:
+		r = &xorshiftReader{x: mrand.Uint64() | 1}
+	case ContentZero:
+		r = zeroReader{}
+	case ContentText:
+		r = &textReader{x: mrand.Uint64() | 1}
+	default:
+		return nil, fmt.Errorf("unknown content mode %q", mode)
+	}
+
+	if compressRatio > 1 && mode != ContentZero && mode != ContentText {
+		r = &ratioReader{r: r, random: max(int(ratioBlock/compressRatio), 1)}
+	}
+
+	if randomBytes == 0 {
+		return r, nil
+	}
+
+	return makeCycleReader(r, randomBytes, 16<<10)
+}
+
+type chacha8Reader struct {
+	rnd *mrand.ChaCha8
+}
+
+func (c *chacha8Reader) Read(p []byte) (int, error) {
+	n := len(p)
+	for ; len(p) >= 8; p = p[8:] {
+		binary.LittleEndian.PutUint64(p, c.rnd.Uint64())
+	}
+	if len(p) > 0 {
+		var tail [8]byte
+		binary.LittleEndian.PutUint64(tail[:], c.rnd.Uint64())
+		copy(p, tail[:])
+	}
+
+	return n, nil
+}
+
+type xorshiftReader struct {
+	x uint64
+}
+
+func (x *xorshiftReader) Read(p []byte) (int, error) {
+	n := len(p)
+	for ; len(p) >= 8; p = p[8:] {
+		binary.LittleEndian.PutUint64(p, x.next())
+	}
+	if len(p) > 0 {
+		var tail [8]byte
+		binary.LittleEndian.PutUint64(tail[:], x.next())
+		copy(p, tail[:])
+	}
+
+	return n, nil
+}
+
+func (x *xorshiftReader) next() uint64 {
+	x.x = xorshift(x.x)
+	return x.x * 2685821657736338717
+}
+
+func xorshift(x uint64) uint64 {
+	x ^= x >> 12
+	x ^= x << 25
+	x ^= x >> 27
+	return x
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+// textWord is word with separator following it, padded so it can be written with two 8-byte stores
+type textWord struct {
+	lo, hi uint64
+	b      []byte
+}
+
+var textWords = func() []textWord {
+	const vocabulary = `the of and to in is was that for it with as on be at by this had not are but from or have an
+		they which you were her all she there would their we him been has when who will more no if out so said what up
+		its about into than them can only other new some could time these two may then do first any my now such like
+		our over man me even most made after also did many before must through back years where much your way well
+		down should because each just those people how too little state good very make world still own see men work
+		long get here between both life being under never day same another know while last might us great old year`
+
+	var words []textWord
+	for i, w := range strings.Fields(vocabulary) {
+		sep := " "
+		switch {
+		case i%23 == 22:
+			sep = ".\n"
+		case i%7 == 6:
+			sep = ", "
+		}
+
+		var padded [16]byte
+		b := padded[:copy(padded[:], w+sep)]
+		words = append(words, textWord{
+			lo: binary.LittleEndian.Uint64(padded[:8]),
+			hi: binary.LittleEndian.Uint64(padded[8:]),
+			b:  b,
+		})
+	}
+
+	return words
+}()
+
+// textReader writes random words
+type textReader struct {
+	x uint64
+	// Rest of the word which did not fit into last read
+	pending []byte
+}
+
+func (t *textReader) Read(p []byte) (int, error) {
+	n := copy(p, t.pending)
+	t.pending = t.pending[n:]
+
+	for n < len(p) {
+		t.x = xorshift(t.x)
+		// Single draw picks 8 words
+		for bits := t.x; bits != 0 && n < len(p); bits >>= 8 {
+			w := &textWords[bits&0xff%uint64(len(textWords))]
+			if len(p)-n >= 16 {
+				// Padding is overwritten by following words
+				binary.LittleEndian.PutUint64(p[n:], w.lo)
+				binary.LittleEndian.PutUint64(p[n+8:], w.hi)
+				n += len(w.b)
+				continue
+			}
+
+			k := copy(p[n:], w.b)
+			t.pending = w.b[k:]
+			n += k
+		}
+	}
+
+	return n, nil
+}
+
+// ratioReader makes content compressible: in every block of ratioBlock bytes only first random bytes
+// come from r, and the rest are zeros
+type ratioReader struct {
+	r      io.Reader
+	random int
+	// Offset in current block
+	pos int
+}
+
+func (c *ratioReader) Read(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		var k int
+		if c.pos < c.random {
+			var err error
+			k, err = c.r.Read(p[:min(len(p), c.random-c.pos)])
+			if err != nil {
+				return n + k, err
+			}
+		} else {
+			k = min(len(p), ratioBlock-c.pos)
+			clear(p[:k])
+		}
+
+		n += k
+		p = p[k:]
+		c.pos = (c.pos + k) % ratioBlock
+	}
+
+	return n, nil
+}
+
+// Size of content file for sendfile, unless RandomBytes is set
+const defaultContentFileSize = 64 << 20
+
+// Content file is sent in pieces of this size, between which drain and settings are checked
+const contentFilePiece = 1 << 20
+
+// writeContentFile writes content block to temporary file, and returns its path
+func writeContentFile(opts Options) (string, error) {
+	size := opts.RandomBytes
+	if size == 0 {
+		size = defaultContentFileSize
+	}
+
+	r, err := NewContentReader(opts.Content, opts.CompressRatio, 0)
+	if err != nil {
+		return "", err
+	}
+
+	f, err := os.CreateTemp("", "dst-content-*")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	if _, err := io.CopyN(f, r, int64(size)); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+
+	slog.Info("Content file for sendfile written", slog.String("path", f.Name()), slog.Int("size", size))
+	return f.Name(), nil
+}
+
+// serveContentFile sends content file in a loop, until drain or until any limits are set.
+// Response has no length, so client can not tell such end from any other, and it is logged why.
+func (h *handler) serveContentFile(w http.ResponseWriter, progress *paceProgress, l *slog.Logger) (int64, error) {
+	f, err := os.Open(h.contentPath)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return 0, err
+	}
+	defer f.Close()
+
+	// Chunked body would be copied through user space, so body ends with connection instead
+	w.Header().Set("Transfer-Encoding", "identity")
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Accept-Ranges", "bytes")
+
+	gen := h.drains.Load()
+	var n int64
+	for {
+		// Gets down to sendfile via ReadFrom of response, in pieces so drain and settings changes are noticed soon
+		k, err := io.CopyN(w, f, contentFilePiece)
+		n += k
+		progress.written.Add(k)
+		if err == io.EOF {
+			if _, err := f.Seek(0, io.SeekStart); err != nil {
+				return n, err
+			}
+		} else if err != nil {
+			return n, err
+		}
+
+		if h.drains.Load() != gen {
+			l.Debug("End content file response because of drain", slog.Int64("bytes_written", n))
+			return n, nil
+		}
+
+		// Sendfile can not apply limits, so they apply from the next request
+		if settings := h.settings.Load(); settings.Bitrate != 0 || settings.EgressCap != 0 || settings.AbortRate != 0 {
+			l.Debug("End content file response because limits were set", slog.Int64("bytes_written", n))
+			return n, nil
+		}
+	}
+}
@@ -0,0 +1,233 @@
+package server
+
+import (
+	"container/heap"
+	"net/http"
+	"sync"
+	"time"
+
+	"dst/internal/bitrate"
+)
+
+// EgressSharing is how capped egress is shared between responses
+type EgressSharing string
+
+const (
+	// EgressFair shares the cap max-min fairly: responses waiting to write get bytes in turns, so each gets
+	// equal share, and share which slow client does not use goes to the others. It is like fair queueing
+	// of a router, which does not leave the link idle while anyone has bytes to send.
+	EgressFair EgressSharing = "fair"
+	// EgressFirstCome makes responses take bytes from single bucket in the order they ask for them,
+	// so the greediest ones get the most
+	EgressFirstCome EgressSharing = "first-come"
+)
+
+// Bucket may run this far ahead, so small scheduling delays do not lose throughput
+const egressBurst = 50 * time.Millisecond
+
+// Writes are split into pieces of this size, so responses interleave finely enough
+const egressPiece = 16 << 10
+
+// EgressLimiter caps total egress of all responses with token bucket, zero rate means no cap.
+// Safe for concurrent use.
+type EgressLimiter struct {
+	lock    sync.Mutex
+	rate    bitrate.Bitrate
+	sharing EgressSharing
+	// Time when bucket is drained by bytes already let through
+	next time.Time
+
+	// For fair sharing, pieces waiting for their turn, ordered by tag. Tag is virtual time the piece starts at,
+	// which is bytes sent by the stream so far, but never behind clock. Clock is tag of the last piece sent,
+	// so stream which was not waiting does not save up turns.
+	waiting egressQueue
+	clock   float64
+	seq     int64
+}
+
+func NewEgressLimiter(rate bitrate.Bitrate, sharing EgressSharing) *EgressLimiter {
+	return &EgressLimiter{rate: rate, sharing: sharing}
+}
+
+func (l *EgressLimiter) setRate(rate bitrate.Bitrate) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.rate = rate
+	l.wakeHead()
+}
+
+// stream registers new response
+func (l *EgressLimiter) stream() *egressStream {
+	return &egressStream{l: l, wakeC: make(chan struct{}, 1)}
+}
+
+type egressStream struct {
+	l *EgressLimiter
+	// Tag next piece of stream starts at, at least, for fair sharing
+	finish float64
+	// Signalled when piece of stream may have become first in queue
+	wakeC chan struct{}
+}
+
+// wait blocks until n bytes may be written
+func (s *egressStream) wait(n int) {
+	l := s.l
+	now := time.Now()
+
+	l.lock.Lock()
+	if l.rate == 0 {
+		l.lock.Unlock()
+		return
+	}
+
+	if l.sharing != EgressFair {
+		l.next = later(l.next, now).Add(l.pieceTime(n))
+		delay := l.next.Sub(now) - egressBurst
+		l.lock.Unlock()
+
+		if delay > 0 {
+			time.Sleep(delay)
+		}
+		return
+	}
+
+	l.seq++
+	p := &egressWait{s: s, tag: max(l.clock, s.finish), seq: l.seq}
+	heap.Push(&l.waiting, p)
+
+	for {
+		if l.waiting[0] != p {
+			l.lock.Unlock()
+			<-s.wakeC
+			l.lock.Lock()
+			continue
+		}
+
+		now = time.Now()
+		delay := later(l.next, now).Sub(now) - egressBurst
+		if l.rate == 0 || delay <= 0 {
+			heap.Pop(&l.waiting)
+			if l.rate != 0 {
+				l.next = later(l.next, now).Add(l.pieceTime(n))
+			}
+			l.clock = p.tag
+			s.finish = p.tag + float64(n)
+			l.wakeHead()
+			l.lock.Unlock()
+			return
+		}
+
+		l.lock.Unlock()
+		t := time.NewTimer(delay)
+		select {
+		case <-t.C:
+		case <-s.wakeC:
+			// Rate has changed
+			t.Stop()
+		}
+		l.lock.Lock()
+	}
+}
+
+// pieceTime is how long n bytes take at the cap
+func (l *EgressLimiter) pieceTime(n int) time.Duration {
+	return time.Duration(float64(n) / float64(l.rate) * float64(time.Second))
+}
+
+// wakeHead signals stream of the first waiting piece, which sleeps until its turn or waits to become first
+func (l *EgressLimiter) wakeHead() {
+	if len(l.waiting) == 0 {
+		return
+	}
+
+	select {
+	case l.waiting[0].s.wakeC <- struct{}{}:
+	default:
+	}
+}
+
+// egressWait is piece waiting for its turn
+type egressWait struct {
+	s   *egressStream
+	tag float64
+	// Breaks ties of tags, so equal ones are served in arrival order
+	seq int64
+}
+
+// egressQueue is heap of waiting pieces, implementing heap.Interface
+type egressQueue []*egressWait
+
+func (q egressQueue) Len() int {
+	return len(q)
+}
+
+func (q egressQueue) Less(i, j int) bool {
+	if q[i].tag != q[j].tag {
+		return q[i].tag < q[j].tag
+	}
+
+	return q[i].seq < q[j].seq
+}
+
+func (q egressQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+}
+
+func (q *egressQueue) Push(x any) {
+	*q = append(*q, x.(*egressWait))
+}
+
+func (q *egressQueue) Pop() any {
+	old := *q
+	p := old[len(old)-1]
+	old[len(old)-1] = nil
+	*q = old[:len(old)-1]
+
+	return p
+}
+
+func later(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+
+	return b
+}
+
+// egressWriter lets writes through as egress cap allows
+type egressWriter struct {
+	w http.ResponseWriter
+	s *egressStream
+}
+
+func (e *egressWriter) Header() http.Header {
+	return e.w.Header()
+}
+
+func (e *egressWriter) WriteHeader(statusCode int) {
+	e.w.WriteHeader(statusCode)
+}
+
+func (e *egressWriter) Write(p []byte) (int, error) {
+	var n int
+	for len(p) > 0 {
+		piece := p[:min(len(p), egressPiece)]
+		e.s.wait(len(piece))
+
+		n_, err := e.w.Write(piece)
+		n += n_
+		if err != nil {
+			return n, err
+		}
+		p = p[len(piece):]
+	}
+
+	return n, nil
+}
+
+func (e *egressWriter) Flush() {
+	if f, ok := e.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
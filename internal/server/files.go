@@ -0,0 +1,95 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"path"
+)
+
+// Media types which may be missing from system MIME tables, but players care about
+var mediaTypes = map[string]string{
+	".m3u8": "application/vnd.apple.mpegurl",
+	".mpd":  "application/dash+xml",
+	".ts":   "video/mp2t",
+	".m4s":  "video/iso.segment",
+	".mp4":  "video/mp4",
+	".m4v":  "video/mp4",
+	".m4a":  "audio/mp4",
+	".aac":  "audio/aac",
+	".webm": "video/webm",
+	".vtt":  "text/vtt",
+}
+
+// serveFile responds with file under Root, paced by current bitrate just like random bytes.
+// Range and conditional requests are handled by http.ServeContent.
+func (h *handler) serveFile(w http.ResponseWriter, r *http.Request, p *pacer) (int64, error) {
+	// http.Dir does not let path escape root
+	f, err := http.Dir(h.opts.Root).Open(r.URL.Path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			http.Error(w, "not found", http.StatusNotFound)
+		} else {
+			http.Error(w, "forbidden", http.StatusForbidden)
+		}
+		return 0, nil
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return 0, err
+	}
+	if fi.IsDir() {
+		http.Error(w, "not found", http.StatusNotFound)
+		return 0, nil
+	}
+
+	w.Header().Set("ETag", fmt.Sprintf(`"%x-%x"`, fi.ModTime().UnixNano(), fi.Size()))
+	if ctype, ok := mediaTypes[path.Ext(fi.Name())]; ok {
+		w.Header().Set("Content-Type", ctype)
+	}
+
+	// ServeContent writes body into the pipe, and it is copied from there to w by pacing loop
+	pr, pw := io.Pipe()
+	type result struct {
+		n   int64
+		err error
+	}
+	resC := make(chan result, 1)
+	// Drain cuts file short, so connection is closed as response falls short of its length
+	in := &drainReader{r: pr, drains: &h.drains, gen: h.drains.Load()}
+	go func() {
+		n, err := p.copy(w, in)
+		// Stops ServeContent if writing failed
+		pr.CloseWithError(err)
+		resC <- result{n, err}
+	}()
+
+	http.ServeContent(&pipeWriter{w: w, pw: pw}, r, fi.Name(), fi.ModTime(), f)
+	pw.Close()
+
+	res := <-resC
+	return res.n, res.err
+}
+
+// pipeWriter writes headers to response, and body to the pipe
+type pipeWriter struct {
+	w  http.ResponseWriter
+	pw *io.PipeWriter
+}
+
+func (p *pipeWriter) Header() http.Header {
+	return p.w.Header()
+}
+
+func (p *pipeWriter) WriteHeader(statusCode int) {
+	p.w.WriteHeader(statusCode)
+}
+
+func (p *pipeWriter) Write(b []byte) (int, error) {
+	return p.pw.Write(b)
+}
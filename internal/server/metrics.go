@@ -0,0 +1,223 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"dst/internal/conntrack"
+)
+
+// TickStats counts pacing ticks, and ticks which were missed because writing or generating data took too long
+type TickStats struct {
+	Total  atomic.Int64
+	Missed atomic.Int64
+}
+
+// Metrics tracks connections served and bytes written to them. Safe for concurrent use.
+type Metrics struct {
+	start time.Time
+	conns conntrack.Tracker[connExt]
+
+	requests atomic.Int64
+	egress   atomic.Int64
+	ticks    TickStats
+
+	slots admission
+}
+
+// connExt is state server keeps for connection on top of what tracker does
+type connExt struct {
+	// Whether connection holds slot under connection limit, guarded by admission lock
+	admitted bool
+	// Progress of current or last response
+	pace atomic.Pointer[paceProgress]
+}
+
+type connStats = conntrack.Conn[connExt]
+
+func NewMetrics() *Metrics {
+	m := &Metrics{start: time.Now()}
+	m.conns.LogLevel = slog.LevelDebug
+	m.conns.OnState = m.connState
+
+	return m
+}
+
+// ConnContext is meant for http.Server.ConnContext, it starts tracking the connection
+func (m *Metrics) ConnContext(ctx context.Context, c net.Conn) context.Context {
+	return m.conns.ConnContext(ctx, c)
+}
+
+// ConnState is meant for http.Server.ConnState, it stops tracking closed connections
+func (m *Metrics) ConnState(c net.Conn, state http.ConnState) {
+	m.conns.ConnState(c, state)
+}
+
+// connStats returns stats of connection request is served over, nil if it is not tracked or m is nil
+func (m *Metrics) connStats(ctx context.Context) *connStats {
+	if m == nil {
+		return nil
+	}
+
+	return m.conns.FromContext(ctx)
+}
+
+// connState gives back slot of connection once it is done with requests in flight
+func (m *Metrics) connState(st *connStats, state http.ConnState) {
+	if state == http.StateIdle || state == http.StateClosed || state == http.StateHijacked {
+		m.slots.leave(st)
+	}
+}
+
+// closeConns closes all connections but the given one right away, or if gracefully, once they are idle.
+// Returns number of connections.
+func (m *Metrics) closeConns(gracefully bool, except *connStats) int {
+	return m.conns.CloseAll(gracefully, except)
+}
+
+// ConnStatus is state of single active connection
+type ConnStatus struct {
+	RemoteAddr   string  `json:"remote_addr"`
+	Duration     float64 `json:"duration_seconds"`
+	Requests     int64   `json:"requests"`
+	BytesWritten int64   `json:"bytes_written"`
+	// Throughput is lifetime average since the connection was opened, and RecentRate is average over last
+	// few seconds. Both are bytes per second.
+	Throughput float64 `json:"throughput"`
+	RecentRate float64 `json:"recent_rate"`
+	// TargetRate is bitrate of current or last response, 0 if unlimited, and AchievedRate is its average rate
+	// since it started. Both are bytes per second.
+	TargetRate   int64   `json:"target_rate"`
+	AchievedRate float64 `json:"achieved_rate"`
+}
+
+// Status is snapshot of server metrics
+type Status struct {
+	Uptime            float64      `json:"uptime_seconds"`
+	ActiveConnections int64        `json:"active_connections"`
+	TotalConnections  int64        `json:"total_connections"`
+	Requests          int64        `json:"requests"`
+	EgressBytes       int64        `json:"egress_bytes"`
+	PacingTicks       int64        `json:"pacing_ticks"`
+	MissedTicks       int64        `json:"missed_ticks"`
+	Connections       []ConnStatus `json:"connections"`
+}
+
+func (m *Metrics) Status() Status {
+	now := time.Now()
+	st := Status{
+		Uptime:            now.Sub(m.start).Seconds(),
+		ActiveConnections: m.conns.Active(),
+		TotalConnections:  m.conns.Accepted(),
+		Requests:          m.requests.Load(),
+		EgressBytes:       m.egress.Load(),
+		PacingTicks:       m.ticks.Total.Load(),
+		MissedTicks:       m.ticks.Missed.Load(),
+		Connections:       []ConnStatus{},
+	}
+
+	m.conns.Range(func(c *connStats) bool {
+		cs := ConnStatus{
+			RemoteAddr:   c.RemoteAddr,
+			Duration:     now.Sub(c.Start).Seconds(),
+			Requests:     c.Requests.Load(),
+			BytesWritten: c.Written(),
+			Throughput:   c.Throughput(),
+			RecentRate:   c.RecentRate(),
+		}
+		if p := c.Ext.pace.Load(); p != nil {
+			cs.TargetRate = p.target.Load()
+			cs.AchievedRate = p.achieved()
+		}
+
+		st.Connections = append(st.Connections, cs)
+		return true
+	})
+
+	sort.Slice(st.Connections, func(i, j int) bool {
+		return st.Connections[i].Duration > st.Connections[j].Duration
+	})
+
+	return st
+}
+
+// ServeHTTP responds with status as JSON
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(m.Status()); err != nil {
+		slog.Error("Failed to write status: " + err.Error())
+	}
+}
+
+// LogEvery logs summary of metrics every interval, until stopC is closed
+func (m *Metrics) LogEvery(interval time.Duration, stopC chan struct{}) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	lastEgress, lastMissed := m.egress.Load(), m.ticks.Missed.Load()
+	lastAt := time.Now()
+
+	for {
+		select {
+		case <-stopC:
+			return
+		case <-t.C:
+		}
+
+		now := time.Now()
+		egress, missed := m.egress.Load(), m.ticks.Missed.Load()
+
+		slog.Info("Server stats", slog.Int64("active_connections", m.conns.Active()),
+			slog.Int64("total_connections", m.conns.Accepted()), slog.Int64("requests", m.requests.Load()),
+			slog.Int64("egress_bytes", egress),
+			slog.Int64("egress_rate", int64(float64(egress-lastEgress)/now.Sub(lastAt).Seconds())),
+			slog.Int64("missed_ticks", missed-lastMissed))
+
+		lastEgress, lastMissed, lastAt = egress, missed, now
+	}
+}
+
+// statsWriter adds written bytes to connection and server stats
+type statsWriter struct {
+	w  http.ResponseWriter
+	m  *Metrics
+	st *connStats
+}
+
+func (s *statsWriter) Header() http.Header {
+	return s.w.Header()
+}
+
+func (s *statsWriter) WriteHeader(statusCode int) {
+	s.w.WriteHeader(statusCode)
+}
+
+func (s *statsWriter) Write(p []byte) (int, error) {
+	n, err := s.w.Write(p)
+	s.st.AddWritten(int64(n))
+	s.m.egress.Add(int64(n))
+
+	return n, err
+}
+
+// ReadFrom lets response use sendfile when copying from file
+func (s *statsWriter) ReadFrom(r io.Reader) (int64, error) {
+	n, err := io.Copy(s.w, r)
+	s.st.AddWritten(n)
+	s.m.egress.Add(n)
+
+	return n, err
+}
+
+func (s *statsWriter) Flush() {
+	if f, ok := s.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
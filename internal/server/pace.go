@@ -0,0 +1,201 @@
+package server
+
+import (
+	"io"
+	"math"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"dst/internal/bitrate"
+)
+
+// Pacing tunes how responses are paced to bitrate
+type Pacing struct {
+	// Tick is how often budget of bytes is written
+	Tick time.Duration
+	// FlushInterval is how often written bytes are flushed to connection, 0 flushes on every tick
+	FlushInterval time.Duration
+	// CatchUp is how much budget, in time at bitrate, may pile up while writing or generating data is too slow.
+	// It is spent faster than bitrate once writing goes again. Time lost beyond that is lost for good,
+	// so one stall does not make response burst for long.
+	CatchUp time.Duration
+}
+
+var DefaultPacing = Pacing{
+	Tick:          40 * time.Millisecond,
+	FlushInterval: 200 * time.Millisecond,
+	CatchUp:       time.Second,
+}
+
+// CopyPaced copies from in to w at given bitrate with DefaultPacing, until in is exhausted or writing fails.
+// If w is http.Flusher, it is flushed every FlushInterval. If ticks is not nil, ticks are counted there,
+// including ticks missed because writing or reading in was too slow.
+func CopyPaced(w io.Writer, in io.Reader, b bitrate.Bitrate, ticks *TickStats) (int64, error) {
+	p := &pacer{Pacing: DefaultPacing, rate: func() bitrate.Bitrate { return b }, ticks: ticks}
+	return p.copy(w, in)
+}
+
+// paceProgress is progress of single paced response, safe for concurrent use
+type paceProgress struct {
+	start time.Time
+	// Current bitrate, 0 means unlimited
+	target  atomic.Int64
+	written atomic.Int64
+}
+
+func newPaceProgress() *paceProgress {
+	return &paceProgress{start: time.Now()}
+}
+
+// achieved is average rate since the response started, bytes per second
+func (p *paceProgress) achieved() float64 {
+	return float64(p.written.Load()) / time.Since(p.start).Seconds()
+}
+
+// pacer copies at bitrate which may change while copying, 0 means unlimited. Bytes are let through
+// by token bucket, which is filled by time passed rather than ticks, so late ticks do not lower the rate.
+type pacer struct {
+	Pacing
+	rate func() bitrate.Bitrate
+	// Optional stats: ticks are shared by all responses, progress is of this one
+	ticks    *TickStats
+	progress *paceProgress
+}
+
+func (p *pacer) copy(w io.Writer, in io.Reader) (int64, error) {
+	t := time.NewTicker(p.Tick)
+	defer t.Stop()
+
+	stopC := make(chan struct{})
+	defer close(stopC)
+
+	bufC, errC := runGen(in, max(int(float64(p.rate())*p.Tick.Seconds()), 16<<10), stopC)
+	flushAt := time.Now().Add(p.FlushInterval)
+
+	// Bytes which may be written, and when bucket was last filled
+	tokens := 0.0
+	filledAt := time.Now()
+	lastTick := time.Time{}
+
+	// Generated bytes not written yet, and error which ended generation
+	var pending []byte
+	var genErr error
+
+	var n int64
+	for len(pending) > 0 || genErr == nil {
+		now := <-t.C
+		if p.ticks != nil {
+			var missed int64
+			if !lastTick.IsZero() {
+				// Ticker drops ticks nobody was waiting for, so count them by time passed
+				missed = max(int64((now.Sub(lastTick)+p.Tick/2)/p.Tick)-1, 0)
+			}
+			p.ticks.Total.Add(1 + missed)
+			p.ticks.Missed.Add(missed)
+		}
+		lastTick = now
+
+		rate := float64(p.rate())
+		if p.progress != nil {
+			p.progress.target.Store(int64(rate))
+		}
+
+		if rate == 0 {
+			tokens = math.Inf(1)
+		} else {
+			elapsed := now.Sub(filledAt)
+			if math.IsInf(tokens, 1) {
+				// Bitrate was just set, start pacing from now on
+				tokens, elapsed = 0, p.Tick
+			}
+			tokens = min(tokens+rate*elapsed.Seconds(), rate*(p.CatchUp+p.Tick).Seconds())
+		}
+		filledAt = now
+
+		for tokens >= 1 {
+			if len(pending) == 0 {
+				if genErr != nil {
+					break
+				}
+
+				select {
+				case genErr = <-errC:
+					continue
+				case pending = <-bufC:
+				}
+			}
+
+			n_, err := w.Write(pending[:int(min(tokens, float64(len(pending))))])
+			n += int64(n_)
+			pending = pending[n_:]
+			tokens -= float64(n_)
+			if p.progress != nil {
+				p.progress.written.Add(int64(n_))
+			}
+			if err != nil {
+				return n, err
+			}
+
+			if math.IsInf(tokens, 1) && p.rate() != 0 {
+				// Start pacing from the next tick
+				break
+			}
+		}
+
+		if p.FlushInterval == 0 || time.Now().After(flushAt) {
+			flushAt = time.Now().Add(p.FlushInterval)
+			if f, ok := w.(http.Flusher); ok {
+				f.Flush()
+			}
+		}
+	}
+
+	return n, ignoreEOF(genErr)
+}
+
+func ignoreEOF(err error) error {
+	if err == io.EOF {
+		return nil
+	}
+
+	return err
+}
+
+// runGen reads r in chunks of bufSize in the background. Last chunk may be shorter,
+// after which io.EOF is sent to error channel.
+func runGen(r io.Reader, bufSize int, stopC chan struct{}) (chan []byte, chan error) {
+	buf := make([]byte, bufSize)
+	bufBack := make([]byte, bufSize)
+
+	c := make(chan []byte)
+	e := make(chan error, 1)
+	go func() {
+		for {
+			n, err := io.ReadFull(r, buf)
+			if err == io.ErrUnexpectedEOF {
+				// Deliver the tail before reporting end of input
+				select {
+				case <-stopC:
+					return
+				case c <- buf[:n]:
+				}
+				err = io.EOF
+			}
+			if err != nil {
+				e <- err
+				return
+			}
+
+			select {
+			case <-stopC:
+				return
+			case c <- buf:
+			}
+
+			buf, bufBack = bufBack, buf
+		}
+	}()
+
+	return c, e
+}
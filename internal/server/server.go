@@ -1,14 +1,19 @@
 package server
 
 import (
-	"bufio"
-	"bytes"
+	"context"
 	"crypto/rand"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
+	mrand "math/rand/v2"
 	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"dst/internal/bitrate"
@@ -23,89 +28,360 @@ func generateRequestId() (string, error) {
 	return base64.URLEncoding.EncodeToString(b), nil
 }
 
-func RunServer(port int, b bitrate.Bitrate, randomBytes int) error {
-	slog.Info(fmt.Sprintf("Listen for connection at :%d", port))
+// Settings may be changed while server runs, with admin API. Zero values mean no limits and no faults.
+type Settings struct {
+	// Bitrate limits every response
+	Bitrate bitrate.Bitrate `json:"bitrate"`
+	// EgressCap limits total egress of all responses
+	EgressCap bitrate.Bitrate `json:"egress_cap"`
+	// MaxConns limits number of connections with requests in flight at once, requests over other connections
+	// get 503. Idle keep-alive connections do not count. Lowering it does not cut responses already in flight.
+	MaxConns int `json:"max_conns"`
+	// FaultRate is probability of responding with FaultStatus instead of content
+	FaultRate   float64 `json:"fault_rate"`
+	FaultStatus int     `json:"fault_status"`
+	// AbortRate is probability of cutting connection at random point of response
+	AbortRate float64 `json:"abort_rate"`
+}
+
+func (s *Settings) Validate() error {
+	if s.MaxConns < 0 {
+		return fmt.Errorf("max conns must not be negative")
+	}
+
+	if s.FaultRate < 0 || s.FaultRate > 1 || s.AbortRate < 0 || s.AbortRate > 1 {
+		return fmt.Errorf("fault and abort rates must be between 0 and 1")
+	}
+
+	// Other statuses would not look like failure, 1xx ones are not even final
+	if s.FaultRate > 0 && (s.FaultStatus < 400 || s.FaultStatus > 599) {
+		return fmt.Errorf("fault status must be HTTP error status code, from 400 to 599")
+	}
 
-	err := http.ListenAndServe(fmt.Sprintf(":%d", port), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		requestId, err := generateRequestId()
+	return nil
+}
 
-		l := slog.Default().With(slog.String("request_id", requestId))
-		l.Debug("Start responding to a new request")
+// Options describe how server responds
+type Options struct {
+	// Settings are initial ones
+	Settings
+	// Content is what to respond with, CompressRatio makes random content compressible if above 1
+	Content       ContentMode
+	CompressRatio float64
+	// RandomBytes, if set, is size of content block which is cycled to produce output
+	RandomBytes int
+	// Pacing tunes how responses are paced to Bitrate, zero value means DefaultPacing
+	Pacing Pacing
+	// Sendfile makes RunServer write content block to temporary file, and send it with sendfile
+	// in responses which have no bitrate, egress cap or aborts. Content block is 64MB by default.
+	Sendfile bool
+	// Root, if set, is directory with files to serve instead of random bytes
+	Root string
+	// StatusPath is path of status endpoint, which responds with metrics instead of random bytes. Empty disables it.
+	StatusPath string
+	// AdminPath is path prefix of admin API, empty disables it. AdminToken, if set, is required as bearer token.
+	AdminPath  string
+	AdminToken string
+	// StatsInterval is how often summary of metrics is logged, 0 disables it
+	StatsInterval time.Duration
+	// EgressSharing is how responses share EgressCap
+	EgressSharing EgressSharing
+	// QueueConns makes requests over connections beyond MaxConns wait in line for a free slot up to QueueTimeout,
+	// instead of getting 503 right away
+	QueueConns   bool
+	QueueTimeout time.Duration
+	// ReadHeaderTimeout and IdleTimeout are passed to http.Server
+	ReadHeaderTimeout time.Duration
+	IdleTimeout       time.Duration
+	// ShutdownGrace is how long active connections may keep streaming after shutdown begins, before being cut.
+	// DrainOnShutdown makes responses in flight end cleanly as soon as shutdown begins.
+	ShutdownGrace   time.Duration
+	DrainOnShutdown bool
+}
 
+// Cut point for aborted responses of unknown length is picked up to this many bytes
+const abortMaxBytes = 16 << 20
+
+// ErrAbort is returned by AbortWriter once it cuts response
+var ErrAbort = errors.New("response aborted on purpose")
+
+// RunServer serves until it fails, or until ctx is done, after which it shuts down gracefully
+func RunServer(port int, opts Options, ctx context.Context) error {
+	var contentPath string
+	if opts.Sendfile && opts.Root == "" {
+		var err error
+		contentPath, err = writeContentFile(opts)
 		if err != nil {
-			l.Error("Failed to generate random request ID: " + err.Error())
+			return fmt.Errorf("failed to write content file: %v", err)
 		}
+		defer os.Remove(contentPath)
+	}
+
+	slog.Info(fmt.Sprintf("Listen for connection at :%d", port))
+	if opts.AdminPath != "" && opts.AdminToken == "" {
+		slog.Warn("Admin API is enabled without token, anyone who reaches the server may use it",
+			slog.String("admin_path", opts.AdminPath))
+	}
+
+	m := NewMetrics()
+	if opts.StatsInterval > 0 {
+		stopC := make(chan struct{})
+		defer close(stopC)
+		go m.LogEvery(opts.StatsInterval, stopC)
+	}
+
+	h := newHandler(opts, m)
+	h.contentPath = contentPath
+	srv := &http.Server{
+		Addr:              fmt.Sprintf(":%d", port),
+		Handler:           h,
+		ConnContext:       m.ConnContext,
+		ConnState:         m.ConnState,
+		ReadHeaderTimeout: opts.ReadHeaderTimeout,
+		IdleTimeout:       opts.IdleTimeout,
+	}
+
+	errC := make(chan error, 1)
+	go func() {
+		errC <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errC:
+		slog.Error("Server stopped because of error: " + err.Error())
+		return err
+	case <-ctx.Done():
+	}
 
-		var in io.Reader
-		if randomBytes == 0 {
-			in = bufio.NewReaderSize(rand.Reader, 16<<10)
-		} else {
-			in, err = makeCycleRandomReader(randomBytes, 16<<10)
-			if err != nil {
-				l.Error("Failed to make random reader: " + err.Error())
-				w.WriteHeader(http.StatusInternalServerError)
-				return
-			}
+	slog.Info("Shutting down, stop accepting connections", slog.Int64("active_connections", m.conns.Active()),
+		slog.Duration("grace", opts.ShutdownGrace))
+	if opts.DrainOnShutdown {
+		h.drains.Add(1)
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), opts.ShutdownGrace)
+	defer cancel()
+
+	// Shutdown closes idle connections and waits for active ones to become idle
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		slog.Warn("Cut connections still active after grace period", slog.Int64("active_connections", m.conns.Active()))
+		srv.Close()
+	}
+
+	slog.Info("Server stopped")
+	return nil
+}
+
+// handler responds to any request with random bytes or file under root, unless it is one for status or admin API
+type handler struct {
+	opts     Options
+	m        *Metrics
+	settings atomic.Pointer[Settings]
+	egress   *EgressLimiter
+	// Serializes settings changes
+	adminLock sync.Mutex
+	// Incremented to make responses in flight end
+	drains atomic.Int64
+	// File with pregenerated content for sendfile, if enabled
+	contentPath string
+}
+
+// NewHandler returns handler which responds to any request with random bytes, at given bitrate unless it is 0.
+// Status and admin API are not served, as there are no metrics to report and no connections to manage.
+func NewHandler(opts Options) http.Handler {
+	return newHandler(opts, nil)
+}
+
+func newHandler(opts Options, m *Metrics) *handler {
+	if opts.Pacing == (Pacing{}) {
+		opts.Pacing = DefaultPacing
+	}
+
+	h := &handler{
+		opts:   opts,
+		m:      m,
+		egress: NewEgressLimiter(opts.EgressCap, opts.EgressSharing),
+	}
+
+	settings := opts.Settings
+	h.settings.Store(&settings)
+	if m != nil {
+		m.slots.setLimit(settings.MaxConns)
+	}
+
+	return h
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.m != nil {
+		if h.opts.StatusPath != "" && r.URL.Path == h.opts.StatusPath {
+			h.m.ServeHTTP(w, r)
+			return
 		}
 
-		// Ignore actual offset requested, I mean we provide random bytes anyway
-		w.Header().Set("Accept-Ranges", "bytes")
-
-		var n int64
-		if b == 0 {
-			n, err = io.Copy(w, in)
-		} else {
-			t := time.NewTicker(time.Second / 24)
-			stopC := make(chan struct{})
-			rndC, errC := runGen(in, int(b)/24, stopC, l)
-			in := bytes.NewReader(nil)
-			flushAt := time.Now().Add(time.Second)
-		outer:
-			for {
-				select {
-				case <-errC:
-					return
-				case <-t.C:
-					var buf []byte
-					select {
-					case <-errC:
-						return
-					case buf = <-rndC:
-					}
-
-					in.Reset(buf)
-					var n_ int64
-					n_, err = io.Copy(w, in)
-					n += n_
-					if err != nil {
-						t.Stop()
-						close(stopC)
-						break outer
-					}
-
-					if time.Now().After(flushAt) {
-						flushAt = time.Now().Add(time.Second)
-						if f, ok := w.(http.Flusher); ok {
-							f.Flush()
-						}
-					}
-				}
-			}
+		if h.opts.AdminPath != "" && strings.HasPrefix(r.URL.Path, h.opts.AdminPath+"/") {
+			h.serveAdmin(w, r, strings.TrimPrefix(r.URL.Path, h.opts.AdminPath))
+			return
 		}
+	}
 
-		if err != nil {
-			l.Error("Error writing response: "+err.Error(), slog.Int64("bytes_written", n))
-		} else {
-			l.Debug("Finished responding to the request", slog.Int64("bytes_written", n))
+	requestId, err := generateRequestId()
+
+	l := slog.Default().With(slog.String("request_id", requestId))
+	l.Debug("Start responding to a new request")
+
+	if err != nil {
+		l.Error("Failed to generate random request ID: " + err.Error())
+	}
+
+	settings := h.settings.Load()
+
+	p := &pacer{
+		Pacing: h.opts.Pacing,
+		rate: func() bitrate.Bitrate {
+			return h.settings.Load().Bitrate
+		},
+		progress: newPaceProgress(),
+	}
+	if st := h.m.connStats(r.Context()); st != nil {
+		if !h.admit(r.Context(), st) {
+			l.Debug("Reject request because of connection limit")
+			w.Header().Set("Connection", "close")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		st.Requests.Add(1)
+		h.m.requests.Add(1)
+		w = &statsWriter{w: w, m: h.m, st: st}
+		p.ticks = &h.m.ticks
+		st.Ext.pace.Store(p.progress)
+	}
+
+	if settings.FaultRate > 0 && mrand.Float64() < settings.FaultRate {
+		l.Debug("Inject fault", slog.Int("status", settings.FaultStatus))
+		w.WriteHeader(settings.FaultStatus)
+		return
+	}
+
+	// Responses without any limits are sent from content file with sendfile, if there is one
+	sendfile := h.contentPath != "" && h.opts.Root == "" &&
+		settings.Bitrate == 0 && settings.EgressCap == 0 && settings.AbortRate == 0
+	if !sendfile {
+		w = &egressWriter{w: w, s: h.egress.stream()}
+
+		if settings.AbortRate > 0 && mrand.Float64() < settings.AbortRate {
+			w = NewAbortWriter(w, -1)
 		}
-	}))
+	}
+
+	var n int64
+	switch {
+	case sendfile:
+		n, err = h.serveContentFile(w, p.progress, l)
+	case h.opts.Root != "":
+		n, err = h.serveFile(w, r, p)
+	default:
+		n, err = h.serveRandom(w, p)
+	}
 
+	if err == ErrAbort {
+		l.Debug("Abort response on purpose", slog.Int64("bytes_written", n))
+		// Makes server cut connection without logging
+		panic(http.ErrAbortHandler)
+	}
 	if err != nil {
-		slog.Error("Server stopped because of error: " + err.Error())
-		return err
+		l.Error("Error writing response: "+err.Error(), slog.Int64("bytes_written", n))
+	} else {
+		l.Debug("Finished responding to the request", slog.Int64("bytes_written", n),
+			slog.Int64("target_rate", p.progress.target.Load()), slog.Int64("achieved_rate", int64(p.progress.achieved())))
 	}
+}
 
-	return nil
+// serveRandom responds with generated content
+func (h *handler) serveRandom(w http.ResponseWriter, p *pacer) (int64, error) {
+	in, err := NewContentReader(h.opts.Content, h.opts.CompressRatio, h.opts.RandomBytes)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return 0, fmt.Errorf("failed to make content reader: %v", err)
+	}
+	in = &drainReader{r: in, drains: &h.drains, gen: h.drains.Load()}
+
+	// Ignore actual offset requested, I mean we provide random bytes anyway
+	w.Header().Set("Accept-Ranges", "bytes")
+
+	return p.copy(w, in)
+}
+
+// admit lets connection be served if there is room for it under connection limit,
+// waiting for it in queue if enabled
+func (h *handler) admit(ctx context.Context, st *connStats) bool {
+	if !h.opts.QueueConns {
+		return h.m.slots.take(st)
+	}
+
+	return h.m.slots.wait(ctx, st, h.opts.QueueTimeout)
+}
+
+// drainReader ends reading once drain is requested
+type drainReader struct {
+	r      io.Reader
+	drains *atomic.Int64
+	gen    int64
+}
+
+func (d *drainReader) Read(p []byte) (int, error) {
+	if d.drains.Load() != d.gen {
+		return 0, io.EOF
+	}
+
+	return d.r.Read(p)
+}
+
+// AbortWriter fails with ErrAbort once it has written bytes up to random cut point. Handler is meant
+// to panic with http.ErrAbortHandler then, so connection is cut.
+type AbortWriter struct {
+	w     http.ResponseWriter
+	limit int64
+}
+
+// NewAbortWriter picks cut point within size of response, or within abortMaxBytes if size is not positive
+func NewAbortWriter(w http.ResponseWriter, size int64) *AbortWriter {
+	if size <= 0 {
+		size = abortMaxBytes
+	}
+
+	return &AbortWriter{w: w, limit: mrand.Int64N(size)}
+}
+
+func (a *AbortWriter) Header() http.Header {
+	return a.w.Header()
+}
+
+func (a *AbortWriter) WriteHeader(statusCode int) {
+	a.w.WriteHeader(statusCode)
+}
+
+func (a *AbortWriter) Write(p []byte) (int, error) {
+	abort := false
+	if int64(len(p)) >= a.limit {
+		p = p[:a.limit]
+		abort = true
+	}
+
+	n, err := a.w.Write(p)
+	a.limit -= int64(n)
+	if err == nil && abort {
+		err = ErrAbort
+	}
+
+	return n, err
+}
+
+func (a *AbortWriter) Flush() {
+	if f, ok := a.w.(http.Flusher); ok {
+		f.Flush()
+	}
 }
 
 type looper struct {
@@ -131,9 +407,10 @@ func (l *looper) Read(p []byte) (n int, err error) {
 	return
 }
 
-func makeCycleRandomReader(randomBytes int, minBufSize int) (io.Reader, error) {
+// makeCycleReader reads block of randomBytes from r, and returns reader which cycles it
+func makeCycleReader(r io.Reader, randomBytes int, minBufSize int) (io.Reader, error) {
 	rnd := make([]byte, randomBytes)
-	if _, err := io.ReadFull(rand.Reader, rnd); err != nil {
+	if _, err := io.ReadFull(r, rnd); err != nil {
 		return nil, err
 	}
 
@@ -151,31 +428,3 @@ func makeCycleRandomReader(randomBytes int, minBufSize int) (io.Reader, error) {
 
 	return &looper{bs: bs}, nil
 }
-
-func runGen(r io.Reader, bufSize int, stopC chan struct{}, l *slog.Logger) (chan []byte, chan error) {
-	buf := make([]byte, bufSize)
-	bufBack := make([]byte, bufSize)
-
-	c := make(chan []byte)
-	e := make(chan error, 1)
-	go func() {
-		for {
-			_, err := io.ReadFull(r, buf)
-			if err != nil {
-				l.Error("Error reading from random reader: " + err.Error())
-				e <- err
-				return
-			}
-
-			select {
-			case <-stopC:
-				return
-			case c <- buf:
-			}
-
-			buf, bufBack = bufBack, buf
-		}
-	}()
-
-	return c, e
-}